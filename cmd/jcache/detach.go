@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	// own process group; the build tool must not take the helper down with us
+	return &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	// own process group; the build tool must not take the helper down with us
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
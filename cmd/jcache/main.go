@@ -6,19 +6,137 @@ import (
 	"github.com/baeda/jcache/internal/app/jcache"
 	"github.com/pkg/errors"
 	"io/ioutil"
+	"log/slog"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 const UsageText = `Usage: %s [options] COMPILER [compiler options]
 
 Options:
     -c, --clear          clear the cache completely
+    -s, --show-stats     show cache statistics
+        --list           list all entries: key, size, age, hits, compiler
+                         and the directory holding the sources
+        --show KEY       show the entry whose key starts with KEY
+    -z, --zero-stats     zero cache statistics
+        --cleanup        remove stored objects no entry refers to
+        --verify         check all entries against their manifests and move
+                         corrupt ones to <path>/quarantine
+        --export FILE    write verified entries to a .tar, .tar.gz or .tar.zst
+                         archive (.tar.zst needs the zstd command)
+        --since AGE      export only entries created within AGE, e.g. 7d
+        --namespace NAME export only entries stored under namespace NAME
+        --import FILE    add the verified entries of an archive written by
+                         --export that are missing locally
+        --upgrade-cache  convert all entries to the current cache format.
+                         Entries of an older format are otherwise converted
+                         when they are looked up, unless the cache is
+                         read-only
+        --flush-uploads  wait until all queued uploads to the shared cache
+                         have been attempted
+        --get-config KEY print the value of configuration KEY
+        --set-config KEY=VALUE
+                         set configuration KEY to VALUE in the user file
+        --print-config   print all configuration values and their origin
 
     -h, --help           print this help text and exit
     -v, --version        print version and copyright information and exit
 
+Configuration is read from the system file (/etc/jcache/jcache.conf), the
+user file ($XDG_CONFIG_HOME/jcache/jcache.conf), the first .jcache.conf found
+in the current directory or any of its parents and finally from JCACHE_<KEY>
+environment variables, each one overriding the former. Files contain one
+'key = value' per line. Keys are:
+
+    path                 cache directory (default: $XDG_CACHE_HOME/jcache)
+    verbose              log to stdout and <path>/log.txt if true
+    log_level            'debug', 'info' (default), 'warn' or 'error'
+    log_format           'text' (default) or 'json' for one JSON object per
+                         line carrying the invocation id, key, phase,
+                         duration and outcome
+    log_max_size         MiB log.txt may grow to before it is rotated to
+                         log.txt.1 (default: 10). 0 never rotates
+    log_max_files        number of rotated log files kept (default: 3)
+    report               append one JSON line per invocation to this file:
+                         timestamp, cwd, compiler, key, outcome ('hit',
+                         'miss', 'uncacheable' or 'fallback') and reason,
+                         source count, restored bytes, phase durations and
+                         the compiler's exit code
+    tag                  label of the report lines, e.g. the CI job
+    disable              run the compiler directly, bypassing the cache
+    readonly             use cache hits but never write to the cache
+                         directory: no entries, stats or log.txt
+    recache              always compile and overwrite cached entries
+    secondary_dir        shared cache directory consulted on a local miss
+    secondary_mode       'ro' (default), 'rw' to also publish new entries
+                         or 'wo' to only publish new entries
+    secondary_umask      octal umask for files published to the shared cache
+    secondary_group      group owning files published to the shared cache
+    async_uploads        publish to the shared cache in the background
+                         (default: true)
+    upload_queue_size    maximum number of queued uploads (default: 256)
+    remote_timeout       timeout of a single shared cache request (default: 10s)
+    remote_max_failures  consecutive shared cache failures before it is
+                         skipped (default: 3)
+    remote_cooldown      how long a failing shared cache is skipped
+                         (default: 5m)
+    storage_layout       'tree' (default), 'objects' to deduplicate files of
+                         new entries in a content-addressed store or 'packed'
+                         to store each new entry as a single archive
+    compression          'none' (default) or 'gzip' to compress new entries
+                         (deflate members for 'packed')
+    compression_level    gzip level from 1 (fastest) to 9 (smallest)
+                         (default: 6)
+    restore_strategy     how uncompressed files are restored: 'copy',
+                         'reflink', 'hardlink' (makes cached files read-only),
+                         'copy_file_range' or 'auto' (default) for reflink,
+                         then copy_file_range. Falls back to 'copy' where
+                         unsupported
+    restore_skip_identical
+                         leave outputs that already hold the cached content
+                         untouched (default: true)
+    restore_remove_stale remove outputs an earlier restore of the same
+                         compiler flags wrote that the restored entry lacks,
+                         e.g. classes of deleted sources. Ownership is
+                         recorded in .jcache-outputs.json inside each output
+                         directory. Do not enable it for incremental builds:
+                         recompiling a subset of the sources with the same
+                         flags removes the classes of all other sources
+    restore_mtime        mtime of restored files: 'now' (default),
+                         'preserve' the compiler's, 'source_date_epoch' to
+                         preserve it clamped to $SOURCE_DATE_EPOCH, which
+                         must be set, or 'newest_source' for that of the
+                         newest source file
+    restore_fsync        'none' (default), 'files' to flush restored files
+                         or 'all' to also flush their directories
+    restore_verify       check the digest of restored files and recompile
+                         entries failing the check (default: true). Their
+                         size is always checked
+    namespace            label stored with new entries, e.g. the project,
+                         to select them by with --export --namespace
+    hash_algorithm       'sha256' (default), 'sha512_256' or 'blake3' for
+                         keys and digests. blake3 is the fastest, sha256
+                         comes close on CPUs with SHA extensions.
+                         Entries stored with another algorithm are misses
+    git_fingerprints     take the digests of clean sources in git working
+                         trees from the git index (default: false)
+    io_concurrency       number of files read or written at once
+                         (default: number of CPUs)
+
+Spans of the lookup, hashing, shared cache, compile, store and restore
+phases are exported to an OpenTelemetry collector over OTLP/HTTP if
+OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT is set.
+They nest under the span named by TRACEPARENT, if set.
+OTEL_EXPORTER_OTLP_HEADERS, OTEL_EXPORTER_OTLP_TIMEOUT and
+OTEL_SERVICE_NAME are honored as well.
+
 Full documentation at: <https://github.com/baeda/jcache>
 `
 const VersionText = `jcache v%s
@@ -27,6 +145,8 @@ Copyright (c) 2018 Peter Skrypalle
 `
 
 const ErrorText = `%[1]s: %[2]v`
+const WarningText = `%[1]s: warning: %[2]v
+`
 const CliErrorText = ErrorText + `
 Try '%[1]s --help' for more information.
 `
@@ -37,35 +157,263 @@ const (
 	ExitErr
 )
 
+// version is set at link time with -ldflags "-X main.version=..."
+var version = "UNKNOWN"
+
+var conf *jcache.Conf
+
 var basePath string
 var verbose bool
+var logLevel slog.Level
+var logFormat string
+var logMaxSize int64
+var logMaxFiles int
+var reportPath string
+var tag string
+var traceConfig jcache.TraceConfig
+var disable bool
+var readOnly bool
+var recache bool
+
+var secondaryDir string
+var secondaryMode jcache.TierMode
+var secondaryUmask os.FileMode
+var secondaryGroup string
+var asyncUploads bool
+var uploadQueueSize int
+var breaker jcache.BreakerConfig
+var layout string
+var compression string
+var compressionLevel int
+var restoreStrategy string
+var skipIdentical bool
+var removeStale bool
+var restoreMTime string
+var sourceDateEpoch time.Time
+var fsync string
+var restoreVerify bool
+var ioConcurrency int
+var gitFingerprints bool
+var hashAlgo string
+var namespace string
 
 type CLI struct {
-	clear   bool
-	version bool
+	clear        bool
+	showStats    bool
+	list         bool
+	show         string
+	zeroStats    bool
+	verify       bool
+	cleanup      bool
+	export       string
+	since        string
+	namespace    string
+	importPath   string
+	upgradeCache bool
+	flushUploads bool
+	drainUploads bool
+	getConfig    string
+	setConfig    string
+	printConfig  bool
+	version      bool
 }
 
 func init() {
-	basePath = os.Getenv("JCACHE_PATH")
-	if basePath == "" {
-		basePath = filepath.Dir(os.Args[0])
-	}
+	cwd, _ := os.Getwd()
+	loadConf(cwd)
+}
+
+// loadConf sets the configuration globals for an invocation in cwd.
+// Invalid values fall back to their defaults; conf.Errors reports them.
+func loadConf(cwd string) {
+	var err error
+	conf = jcache.LoadConf(cwd)
+
+	basePath = conf.String("path")
 	if abs, err := filepath.Abs(basePath); err == nil {
 		basePath = abs
 	}
-	v, err := strconv.ParseBool(os.Getenv("JCACHE_VERBOSE"))
-	if err != nil {
-		verbose = false
+	verbose = conf.Bool("verbose")
+	logLevel, err = jcache.ParseLogLevel(conf.String("log_level"))
+	conf.Reject("log_level", err)
+	logFormat, err = jcache.ParseLogFormat(conf.String("log_format"))
+	conf.Reject("log_format", err)
+	logMaxSize = int64(conf.Int("log_max_size")) << 20
+	logMaxFiles = conf.Int("log_max_files")
+	reportPath = conf.String("report")
+	tag = conf.String("tag")
+	traceConfig = jcache.TraceConfigFromEnv()
+	traceConfig.Version = version
+	disable = conf.Bool("disable")
+	readOnly = conf.Bool("readonly")
+	recache = conf.Bool("recache")
+
+	secondaryDir = conf.String("secondary_dir")
+	secondaryMode, err = jcache.ParseTierMode(conf.String("secondary_mode"))
+	conf.Reject("secondary_mode", err)
+	secondaryUmask = conf.FileMode("secondary_umask")
+	secondaryGroup = conf.String("secondary_group")
+	asyncUploads = conf.Bool("async_uploads")
+	uploadQueueSize = conf.Int("upload_queue_size")
+
+	breaker.Timeout = conf.Duration("remote_timeout")
+	breaker.MaxFailures = conf.Int("remote_max_failures")
+	breaker.Cooldown = conf.Duration("remote_cooldown")
+	breaker.ReadOnly = readOnly
+
+	layout, err = jcache.ParseLayout(conf.String("storage_layout"))
+	conf.Reject("storage_layout", err)
+	compression, err = jcache.ParseCompression(conf.String("compression"))
+	conf.Reject("compression", err)
+	compressionLevel, err = jcache.ParseCompressionLevel(conf.String("compression_level"))
+	conf.Reject("compression_level", err)
+	restoreStrategy, err = jcache.ParseRestoreStrategy(conf.String("restore_strategy"))
+	conf.Reject("restore_strategy", err)
+	skipIdentical = conf.Bool("restore_skip_identical")
+	removeStale = conf.Bool("restore_remove_stale")
+	restoreMTime, err = jcache.ParseMTimePolicy(conf.String("restore_mtime"))
+	conf.Reject("restore_mtime", err)
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		sourceDateEpoch = time.Unix(epoch, 0).UTC()
+	} else if restoreMTime == jcache.MTimeSourceDateEpoch {
+		conf.Reject("restore_mtime", errors.New("SOURCE_DATE_EPOCH not set"))
+		restoreMTime = jcache.MTimeNow
 	}
-	verbose = v
+	fsync, err = jcache.ParseFsyncPolicy(conf.String("restore_fsync"))
+	conf.Reject("restore_fsync", err)
+	restoreVerify = conf.Bool("restore_verify")
+	ioConcurrency = conf.Int("io_concurrency")
+	gitFingerprints = conf.Bool("git_fingerprints")
+	hashAlgo, err = jcache.ParseHashAlgo(conf.String("hash_algorithm"))
+	conf.Reject("hash_algorithm", err)
+	namespace = conf.String("namespace")
 }
 
 func printUsage() {
 	fmt.Fprintf(os.Stderr, UsageText, os.Args[0])
 }
 
+func printStats(stats *jcache.Stats, usage jcache.Usage) {
+	fmt.Fprintf(os.Stdout, "cache directory          %s\n", basePath)
+	if !stats.ZeroedAt.IsZero() {
+		fmt.Fprintf(os.Stdout, "stats zeroed             %v\n", stats.ZeroedAt.Local())
+	}
+	fmt.Fprintf(os.Stdout, "cache hit                %d\n", stats.Hits)
+	fmt.Fprintf(os.Stdout, "  from shared cache      %d\n", stats.TierHits)
+	fmt.Fprintf(os.Stdout, "cache miss               %d\n", stats.Misses)
+	fmt.Fprintf(os.Stdout, "shared cache errors      %d\n", stats.RemoteErrors)
+	fmt.Fprintf(os.Stdout, "  timeouts               %d\n", stats.RemoteTimeouts)
+	fmt.Fprintf(os.Stdout, "shared cache skipped     %d\n", stats.RemoteSkips)
+	fmt.Fprintf(os.Stdout, "cached entries           %d\n", usage.Entries)
+	fmt.Fprintf(os.Stdout, "cache size               %d bytes\n", usage.StoredBytes)
+	fmt.Fprintf(os.Stdout, "  uncompressed           %d bytes\n", usage.RawBytes)
+	fmt.Fprintf(os.Stdout, "  compression ratio      %.2f\n", usage.CompressionRatio())
+	if len(stats.Phases) > 0 {
+		fmt.Fprintf(os.Stdout, "time spent\n")
+		names := make([]string, 0, len(stats.Phases))
+		for name := range stats.Phases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stdout, "  %-22s %v\n", name, stats.Phases[name])
+		}
+	}
+}
+
+// formatAge rounds d to its largest unit, e.g. 3d or 12m.
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+func printEntries(entries []jcache.EntrySummary) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "KEY\tSIZE\tAGE\tHITS\tCOMPILER\tSOURCES\n")
+	for _, e := range entries {
+		compiler := "-"
+		if len(e.Info.Args) > 0 {
+			compiler = e.Info.Args[0]
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%s\t%s\n", e.Key[:16], e.StoredBytes,
+			formatAge(time.Since(e.Info.CreatedAt)), e.Usage.Hits, compiler, e.SourceDir)
+	}
+	tw.Flush()
+}
+
+func printEntry(e *jcache.EntryDetails) {
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+
+	fmt.Fprintf(os.Stdout, "key                      %s\n", e.Key)
+	if e.Info.Namespace != "" {
+		fmt.Fprintf(os.Stdout, "namespace                %s\n", e.Info.Namespace)
+	}
+	fmt.Fprintf(os.Stdout, "created                  %v\n", e.Info.CreatedAt.Local())
+	fmt.Fprintf(os.Stdout, "  by                     %s@%s\n", orUnknown(e.Info.User), orUnknown(e.Info.Host))
+	fmt.Fprintf(os.Stdout, "  with jcache            %s\n", orUnknown(e.Info.Version))
+	fmt.Fprintf(os.Stdout, "hits                     %d\n", e.Usage.Hits)
+	if !e.Usage.LastHit.IsZero() {
+		fmt.Fprintf(os.Stdout, "  last                   %v\n", e.Usage.LastHit.Local())
+	}
+	fmt.Fprintf(os.Stdout, "args                     %s\n", orUnknown(strings.Join(e.Info.Args, " ")))
+	fmt.Fprintf(os.Stdout, "exit code                %d\n", e.Exec.Exit)
+	fmt.Fprintf(os.Stdout, "storage                  %s, %s, %s\n",
+		e.Storage.Layout, e.Storage.Compression, e.Storage.HashAlgo)
+	fmt.Fprintf(os.Stdout, "  size                   %d bytes\n", e.Storage.StoredBytes)
+	fmt.Fprintf(os.Stdout, "  uncompressed           %d bytes\n", e.Storage.RawBytes)
+	fmt.Fprintf(os.Stdout, "sources                  %d\n", len(e.Sources))
+	for _, src := range e.Sources {
+		fmt.Fprintf(os.Stdout, "  %s %v %d bytes %s\n", src.Path, src.ModTime.Local(), src.Size, src.Digest)
+	}
+	fmt.Fprintf(os.Stdout, "outputs                  %d\n", len(e.Outputs))
+	for _, out := range e.Outputs {
+		fmt.Fprintf(os.Stdout, "  %s\n", out)
+	}
+	fmt.Fprintf(os.Stdout, "stdout\n%s", e.Exec.Stdout)
+	fmt.Fprintf(os.Stdout, "stderr\n%s", e.Exec.Stderr)
+}
+
+func setConfig(keyValue string) int {
+	idx := strings.IndexByte(keyValue, '=')
+	if idx < 0 {
+		fmt.Fprintf(os.Stderr, CliErrorText, os.Args[0],
+			"--set-config expects KEY=VALUE")
+		return ExitErrCli
+	}
+
+	path := jcache.UserConfPath()
+	err := jcache.SetConf(path, strings.TrimSpace(keyValue[:idx]), strings.TrimSpace(keyValue[idx+1:]))
+	if err != nil {
+		if _, ok := errors.Cause(err).(jcache.ErrUnknownConfKey); ok {
+			fmt.Fprintf(os.Stderr, CliErrorText, os.Args[0],
+				fmt.Sprintf("%v: %s", err, keyValue[:idx]))
+			return ExitErrCli
+		}
+		if _, ok := errors.Cause(err).(jcache.ErrInvalidConfValue); ok {
+			fmt.Fprintf(os.Stderr, CliErrorText, os.Args[0], err.Error())
+			return ExitErrCli
+		}
+		message := fmt.Sprintf("failed to write configuration '%s' - %v", path, err)
+		fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+		return ExitErr
+	}
+	return ExitSuccess
+}
+
 func printVersion() {
-	fmt.Fprintf(os.Stderr, VersionText, "UNKNOWN")
+	fmt.Fprintf(os.Stderr, VersionText, version)
 }
 
 func main() {
@@ -87,6 +435,25 @@ func mainExitCode() int {
 	cli := CLI{}
 	fs.BoolVar(&cli.clear, "c", false, "")
 	fs.BoolVar(&cli.clear, "clear", false, "")
+	fs.BoolVar(&cli.showStats, "s", false, "")
+	fs.BoolVar(&cli.showStats, "show-stats", false, "")
+	fs.BoolVar(&cli.list, "list", false, "")
+	fs.StringVar(&cli.show, "show", "", "")
+	fs.BoolVar(&cli.zeroStats, "z", false, "")
+	fs.BoolVar(&cli.zeroStats, "zero-stats", false, "")
+	fs.BoolVar(&cli.verify, "verify", false, "")
+	fs.BoolVar(&cli.cleanup, "cleanup", false, "")
+	fs.StringVar(&cli.export, "export", "", "")
+	fs.StringVar(&cli.since, "since", "", "")
+	fs.StringVar(&cli.namespace, "namespace", "", "")
+	fs.StringVar(&cli.importPath, "import", "", "")
+	fs.BoolVar(&cli.upgradeCache, "upgrade-cache", false, "")
+	fs.BoolVar(&cli.flushUploads, "flush-uploads", false, "")
+	fs.StringVar(&cli.getConfig, "get-config", "", "")
+	fs.StringVar(&cli.setConfig, "set-config", "", "")
+	fs.BoolVar(&cli.printConfig, "print-config", false, "")
+	// internal: used by the background helper spawned after a compilation
+	fs.BoolVar(&cli.drainUploads, "drain-uploads", false, "")
 	fs.BoolVar(&cli.version, "v", false, "")
 	fs.BoolVar(&cli.version, "version", false, "")
 
@@ -120,10 +487,186 @@ func mainExitCode() int {
 		}
 	}
 
+	if cli.setConfig != "" {
+		// Changing the configuration is a terminal operation
+		return setConfig(cli.setConfig)
+	}
+
+	for _, err := range conf.Errors() {
+		// a broken configuration must not break the build
+		fmt.Fprintf(os.Stderr, WarningText, os.Args[0], fmt.Sprintf("ignoring configuration - %v", err))
+	}
+
+	if cli.getConfig != "" {
+		// Printing configuration is a terminal operation
+		value, err := conf.Lookup(cli.getConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, CliErrorText, os.Args[0],
+				fmt.Sprintf("%v: %s", err, cli.getConfig))
+			return ExitErrCli
+		}
+		fmt.Fprintln(os.Stdout, value.Value)
+		return ExitSuccess
+	}
+
+	if cli.printConfig {
+		// Printing configuration is a terminal operation
+		for _, value := range conf.Values() {
+			fmt.Fprintf(os.Stdout, "(%s) %s = %s\n", value.Origin, value.Key, value.Value)
+		}
+		return ExitSuccess
+	}
+
+	if cli.showStats {
+		// Printing statistics is a terminal operation
+		stats, err := jcache.LoadStats(basePath)
+		if err != nil {
+			message := fmt.Sprintf("failed to load statistics - %v", err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		usage, err := jcache.CacheUsage(basePath)
+		if err != nil {
+			message := fmt.Sprintf("failed to determine cache size - %v", err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		printStats(stats, usage)
+		return ExitSuccess
+	}
+
+	if cli.list {
+		// Listing entries is a terminal operation
+		entries, err := jcache.ListEntries(basePath)
+		if err != nil {
+			message := fmt.Sprintf("failed to list entries - %v", err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		printEntries(entries)
+		return ExitSuccess
+	}
+
+	if cli.show != "" {
+		// Showing an entry is a terminal operation
+		entry, err := jcache.ShowEntry(basePath, cli.show)
+		if err != nil {
+			message := fmt.Sprintf("failed to show entry - %v", err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		printEntry(entry)
+		return ExitSuccess
+	}
+
+	if cli.zeroStats {
+		err = jcache.ZeroStats(basePath)
+		if err != nil {
+			message := fmt.Sprintf("failed to zero statistics - %v", err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+	}
+
+	if cli.verify {
+		v, err := jcache.Verify(basePath)
+		if err != nil {
+			message := fmt.Sprintf("failed to verify cache directory '%s' - %v", basePath, err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		for _, ce := range v.Corrupt {
+			fmt.Fprintf(os.Stdout, "corrupt %s: %v\n", ce.Path, ce)
+		}
+		fmt.Fprintf(os.Stdout, "verified %d entries, quarantined %d entries and %d objects\n",
+			v.Entries, len(v.Corrupt), v.CorruptObjects)
+	}
+
+	if cli.upgradeCache {
+		u, err := jcache.UpgradeCache(basePath)
+		if err != nil {
+			message := fmt.Sprintf("failed to upgrade cache directory '%s' - %v", basePath, err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		fmt.Fprintf(os.Stdout, "upgraded %d entries to format %d, %d up to date\n",
+			u.Upgraded, jcache.FormatVersion, u.Current)
+		if u.Newer > 0 {
+			fmt.Fprintf(os.Stdout, "left %d entries of a newer format alone\n", u.Newer)
+		}
+		if u.Removed > 0 {
+			fmt.Fprintf(os.Stdout, "removed %d entries that could not be upgraded\n", u.Removed)
+		}
+	}
+
+	if cli.importPath != "" {
+		t, err := jcache.Import(basePath, cli.importPath)
+		if err != nil {
+			message := fmt.Sprintf("failed to import '%s' - %v", cli.importPath, err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		fmt.Fprintf(os.Stdout, "imported %d entries, %d present already, %d rejected\n",
+			t.Entries, t.Existing, t.Rejected)
+	}
+
+	if cli.export != "" {
+		opts := jcache.ExportOptions{Namespace: cli.namespace}
+		if cli.since != "" {
+			if opts.Since, err = jcache.ParseAge(cli.since); err != nil {
+				fmt.Fprintf(os.Stderr, CliErrorText, os.Args[0], err)
+				return ExitErrCli
+			}
+		}
+		t, err := jcache.Export(basePath, cli.export, opts)
+		if err != nil {
+			message := fmt.Sprintf("failed to export to '%s' - %v", cli.export, err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		fmt.Fprintf(os.Stdout, "exported %d entries, left out %d corrupt entries\n",
+			t.Entries, t.Rejected)
+	}
+
+	if cli.cleanup {
+		nObjects, nBytes, err := jcache.PruneObjects(basePath)
+		if err != nil {
+			message := fmt.Sprintf("failed to clean up cache directory '%s' - %v", basePath, err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		fmt.Fprintf(os.Stdout, "removed %d objects (%d bytes)\n", nObjects, nBytes)
+	}
+
+	if cli.drainUploads {
+		// Draining the upload queue is a terminal operation
+		logger := initLogger()
+		jcache.DrainUploads(basePath, initTiers(logger), logger, false)
+		return ExitSuccess
+	}
+
+	if cli.flushUploads {
+		logger := initLogger()
+		remaining, err := jcache.DrainUploads(basePath, initTiers(logger), logger, true)
+		if err != nil {
+			message := fmt.Sprintf("failed to flush uploads - %v", err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		if remaining > 0 {
+			message := fmt.Sprintf("%d uploads failed and remain queued", remaining)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+	}
+
 	args := fs.Args()
 	if len(args) < 1 {
-		if cli.clear {
-			// Clearing cache is a valid terminal operation.
+		if cli.clear || cli.zeroStats || cli.verify || cli.upgradeCache || cli.importPath != "" ||
+			cli.export != "" || cli.cleanup || cli.flushUploads {
+			// Clearing cache, zeroing statistics, verifying, upgrading,
+			// importing, exporting, cleaning up and flushing uploads are
+			// valid terminal operations.
 			return ExitSuccess
 		}
 
@@ -132,14 +675,44 @@ func mainExitCode() int {
 		return ExitErrCli
 	}
 
-	exit, err := jCache(args)
+	report := jcache.NewReport(tag)
+	defer writeReport(report)
+
+	if disable {
+		report.Outcome = jcache.OutcomeUncacheable
+		report.Reason = "cache disabled"
+		report.Compiler.Path = args[0]
+		exit, err := runBackup(args)
+		if err != nil {
+			message := fmt.Sprintf("cannot run '%s': %v", args[0], err)
+			fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+			return ExitErr
+		}
+		report.Exit = exit
+		return exit
+	}
+
+	exit, err := jCache(args, report)
 	if err != nil {
-		return handleCacheError(args, err)
+		report.Outcome = jcache.OutcomeFallback
+		report.Reason = errors.Cause(err).Error()
+		report.Exit = handleCacheError(args, err)
+		return report.Exit
 	}
 
 	return exit
 }
 
+func writeReport(report *jcache.Report) {
+	if reportPath == "" {
+		return
+	}
+	if err := jcache.AppendReport(reportPath, report); err != nil {
+		message := fmt.Sprintf("failed to write report to '%s' - %v", reportPath, err)
+		fmt.Fprintf(os.Stderr, ErrorText, os.Args[0], message)
+	}
+}
+
 func handleCacheError(args []string, err error) int {
 	cause := errors.Cause(err)
 	switch ex := cause.(type) {
@@ -165,11 +738,46 @@ func handleCacheError(args []string, err error) int {
 	return ExitErr
 }
 
-func jCache(args []string) (int, error) {
-	jc, err := jcache.NewCache(
-		basePath,
+func jCache(args []string, report *jcache.Report) (int, error) {
+	logger := initLogger()
+	for _, err := range conf.Errors() {
+		logger.Warn("ignoring configuration - %v", err)
+	}
+	tracer := jcache.NewTracer(traceConfig)
+	defer func() {
+		if err := tracer.Export(); err != nil {
+			logger.Warn("failed to export spans - %+v", err)
+		}
+	}()
+
+	jc, err := jcache.NewCacheWithConfig(
+		jcache.Config{
+			BasePath:         basePath,
+			Tiers:            initTiers(logger),
+			ReadOnly:         readOnly,
+			Recache:          recache,
+			Layout:           layout,
+			Compression:      compression,
+			CompressionLevel: compressionLevel,
+			RestoreStrategy:  restoreStrategy,
+			SkipIdentical:    skipIdentical,
+			RemoveStale:      removeStale,
+			RestoreMTime:     restoreMTime,
+			SourceDateEpoch:  sourceDateEpoch,
+			IOConcurrency:    ioConcurrency,
+			Fsync:            fsync,
+			RestoreVerify:    restoreVerify,
+			GitFingerprints:  gitFingerprints,
+			HashAlgo:         hashAlgo,
+			Namespace:        namespace,
+			Version:          version,
+			AsyncUploads:     asyncUploads,
+			UploadQueueSize:  uploadQueueSize,
+			Report:           report,
+			Tracer:           tracer,
+		},
 		jcache.Command,
-		initLogger(),
+		logger,
 		args,
 	)
 	if err != nil {
@@ -181,6 +789,10 @@ func jCache(args []string) (int, error) {
 		return ExitErr, err
 	}
 
+	if asyncUploads && secondaryDir != "" && !readOnly {
+		startUploadHelper(logger)
+	}
+
 	// Replay javac output
 	fmt.Fprint(os.Stdout, info.Stdout)
 	fmt.Fprint(os.Stderr, info.Stderr)
@@ -193,15 +805,54 @@ func initLogger() jcache.Logger {
 		return jcache.NewLogger(ioutil.Discard)
 	}
 
-	stdout := jcache.NewLogger(os.Stdout)
-	logger, err := jcache.NewFileLogger(filepath.Join(basePath, "log.txt"))
+	stdout := jcache.NewFormatLogger(os.Stdout, logFormat, logLevel)
+	if readOnly {
+		// leave the cache directory untouched
+		return stdout
+	}
+	file, err := jcache.OpenLogFile(filepath.Join(basePath, "log.txt"), logMaxSize, logMaxFiles)
 	if err != nil {
 		// well... just log to stdout
-		logger = stdout
-	} else {
-		logger = jcache.NewLoggerChain(logger, stdout)
+		return stdout
+	}
+	return jcache.NewLoggerChain(jcache.NewFormatLogger(file, logFormat, logLevel), stdout)
+}
+
+func initTiers(logger jcache.Logger) []jcache.Tier {
+	if secondaryDir == "" {
+		return nil
+	}
+
+	tier, err := jcache.NewDirTier(secondaryDir, secondaryMode, secondaryUmask, secondaryGroup)
+	if err != nil {
+		// the shared cache is optional. carry on without it
+		logger.Warn("failed to set up secondary cache %s - %+v", secondaryDir, err)
+		return nil
+	}
+	return []jcache.Tier{jcache.NewBreakerTier(tier, basePath, breaker, logger)}
+}
+
+// startUploadHelper hands queued uploads to a detached jcache process,
+// so that publishing does not add to the latency of this invocation.
+func startUploadHelper(logger jcache.Logger) {
+	pending, err := jcache.PendingUploads(basePath)
+	if err != nil || len(pending) == 0 {
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		logger.Warn("failed to locate jcache executable - %+v", err)
+		return
+	}
+
+	cmd := exec.Command(self, "--drain-uploads")
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		logger.Warn("failed to start upload helper - %+v", err)
+		return
 	}
-	return logger
+	cmd.Process.Release()
 }
 
 func runBackup(args []string) (int, error) {
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/baeda/jcache/internal/app/jcache"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestEmptyTopLevelClass(t *testing.T) {
@@ -93,6 +103,1337 @@ func TestJni(t *testing.T) {
 	)
 }
 
+func TestSecondaryTier(t *testing.T) {
+	c := newCacheTest(t)
+	sharedDir := c.path("shared")
+
+	// first machine populates the shared cache
+	rw, err := jcache.NewDirTier(sharedDir, jcache.TierReadWrite, 0022, "")
+	panicOnErr(err)
+	c.execute(jcache.Config{BasePath: c.path("cache0"), Tiers: []jcache.Tier{rw}})
+
+	// second machine must be served from the shared cache
+	os.RemoveAll(c.outDir)
+	ro, err := jcache.NewDirTier(sharedDir, jcache.TierReadOnly, 0022, "")
+	panicOnErr(err)
+	info := c.execute(jcache.Config{BasePath: c.path("cache1"), Tiers: []jcache.Tier{ro}})
+
+	if c.compiled {
+		t.Fatalf("compiled despite the shared cache")
+	}
+	if info.Exit != 0 {
+		t.Fatalf("exit=%d", info.Exit)
+	}
+	if jcache.DoesNotExist(filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class")) {
+		t.Fatalf("class file not restored from shared cache")
+	}
+}
+
+func TestSecondaryTierReplace(t *testing.T) {
+	c := newCacheTest(t)
+	sharedDir := c.path("shared")
+	rw, err := jcache.NewDirTier(sharedDir, jcache.TierReadWrite, 0022, "")
+	panicOnErr(err)
+	c.execute(jcache.Config{Tiers: []jcache.Tier{rw}})
+	key := filepath.Base(c.entry())
+
+	// a lock left behind by a crashed process
+	staleLock := filepath.Join(sharedDir, key+".lock")
+	panicOnErr(ioutil.WriteFile(staleLock, nil, 0644))
+	past := time.Now().Add(-time.Hour)
+	panicOnErr(os.Chtimes(staleLock, past, past))
+
+	c.execute(jcache.Config{Tiers: []jcache.Tier{rw}, Recache: true})
+	if !c.compiled {
+		t.Fatalf("not recached")
+	}
+	files, err := ioutil.ReadDir(sharedDir)
+	panicOnErr(err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 2 || names[0] != ".staging" || names[1] != key {
+		t.Fatalf("shared cache holds %v", names)
+	}
+	if staged, _ := ioutil.ReadDir(filepath.Join(sharedDir, ".staging")); len(staged) > 0 {
+		t.Fatalf("staged entries left behind: %v", staged)
+	}
+
+	ro, err := jcache.NewDirTier(sharedDir, jcache.TierReadOnly, 0022, "")
+	panicOnErr(err)
+	c.execute(jcache.Config{BasePath: c.path("cache1"), Tiers: []jcache.Tier{ro}})
+	if c.compiled {
+		t.Fatalf("replaced entry not served from the shared cache")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c := newCacheTest(t)
+	c.execute(jcache.Config{})
+	before := c.snapshot(c.basePath)
+
+	// a hit and a miss
+	cfg := jcache.Config{ReadOnly: true}
+	c.execute(cfg)
+	if c.compiled {
+		t.Fatalf("hit compiled")
+	}
+	c.execute(cfg, testSource("RawType"))
+	if !c.compiled {
+		t.Fatalf("miss not compiled")
+	}
+
+	if after := c.snapshot(c.basePath); after != before {
+		t.Fatalf("read-only run changed the cache\nbefore:\n%s\nafter:\n%s", before, after)
+	}
+}
+
+func TestBreakerTier(t *testing.T) {
+	c := newCacheTest(t)
+	remote := &fakeTier{}
+	cfg := jcache.BreakerConfig{Timeout: 100 * time.Millisecond, MaxFailures: 2, Cooldown: time.Hour}
+	tier := jcache.NewBreakerTier(remote, c.basePath, cfg, c.logger)
+	fetch := func() error {
+		_, err := tier.Fetch("key", filepath.Join(c.basePath, "key"))
+		return err
+	}
+
+	// a success resets the count of consecutive failures
+	remote.set(fmt.Errorf("unreachable"), 0)
+	fetch()
+	remote.set(nil, 0)
+	panicOnErr(fetch())
+	remote.set(fmt.Errorf("unreachable"), 0)
+	fetch()
+	if _, open := fetch().(jcache.ErrCircuitOpen); open {
+		t.Fatalf("circuit open after 1 consecutive failure")
+	}
+
+	// the second consecutive failure opened the circuit
+	calls := remote.callCount()
+	if _, open := fetch().(jcache.ErrCircuitOpen); !open || remote.callCount() != calls {
+		t.Fatalf("circuit not open after 2 consecutive failures")
+	}
+	stats, err := jcache.LoadStats(c.basePath)
+	panicOnErr(err)
+	if stats.RemoteErrors != 3 || stats.RemoteSkips != 1 {
+		t.Fatalf("stats=%+v", stats)
+	}
+
+	// the state is shared with other processes
+	tier = jcache.NewBreakerTier(remote, c.basePath, cfg, c.logger)
+	if _, open := fetch().(jcache.ErrCircuitOpen); !open {
+		t.Fatalf("circuit state not shared")
+	}
+
+	// the circuit closes after the cool-down
+	panicOnErr(os.RemoveAll(filepath.Join(c.basePath, "breakers")))
+	cfg.Cooldown = 50 * time.Millisecond
+	tier = jcache.NewBreakerTier(remote, c.basePath, cfg, c.logger)
+	fetch()
+	if _, open := fetch().(jcache.ErrCircuitOpen); open {
+		t.Fatalf("circuit open before the second failure")
+	}
+	if _, open := fetch().(jcache.ErrCircuitOpen); !open {
+		t.Fatalf("circuit not open after 2 consecutive failures")
+	}
+	time.Sleep(2 * cfg.Cooldown)
+	remote.set(nil, 0)
+	panicOnErr(fetch())
+
+	// a timed out fetch leaves its scratch directory behind if the
+	// process exits before it completes. later fetches sweep it
+	remote.set(nil, time.Second)
+	if _, timedOut := fetch().(jcache.ErrTierTimeout); !timedOut {
+		t.Fatalf("fetch did not time out")
+	}
+	scratch, err := filepath.Glob(filepath.Join(c.basePath, ".fetch", "*"))
+	panicOnErr(err)
+	if len(scratch) != 1 {
+		t.Fatalf("scratch=%v", scratch)
+	}
+	remote.set(nil, 0)
+	past := time.Now().Add(-2 * time.Hour)
+	panicOnErr(os.Chtimes(scratch[0], past, past))
+	panicOnErr(fetch())
+	if !jcache.DoesNotExist(scratch[0]) {
+		t.Fatalf("abandoned scratch directory not swept")
+	}
+	stats, err = jcache.LoadStats(c.basePath)
+	panicOnErr(err)
+	if stats.RemoteTimeouts != 1 {
+		t.Fatalf("stats=%+v", stats)
+	}
+}
+
+func TestUploadQueue(t *testing.T) {
+	c := newCacheTest(t)
+	sharedDir := c.path("shared")
+	rw, err := jcache.NewDirTier(sharedDir, jcache.TierReadWrite, 0022, "")
+	panicOnErr(err)
+	cfg := jcache.Config{Tiers: []jcache.Tier{rw}, AsyncUploads: true, UploadQueueSize: 2}
+
+	c.execute(cfg)
+	pending, err := jcache.PendingUploads(c.basePath)
+	panicOnErr(err)
+	if len(pending) != 1 {
+		t.Fatalf("pending=%+v", pending)
+	}
+	first := pending[0]
+
+	// the snapshot taken when queueing is uploaded, not what the entry
+	// holds by the time of the drain. It links the entry's files, which
+	// are replaced rather than rewritten.
+	want, err := ioutil.ReadFile(filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class"))
+	panicOnErr(err)
+	cached := filepath.Join(c.basePath, first.Key, "classes", "jcache", "EmptyTopLevelClass.class")
+	snapshot := filepath.Join(c.basePath, "uploads", "snapshots", first.Snapshot, first.Key, "classes", "jcache", "EmptyTopLevelClass.class")
+	cachedStat, err := os.Stat(cached)
+	panicOnErr(err)
+	snapshotStat, err := os.Stat(snapshot)
+	panicOnErr(err)
+	if !os.SameFile(cachedStat, snapshotStat) {
+		t.Fatalf("snapshot copied")
+	}
+	panicOnErr(ioutil.WriteFile(cached+".tmp", []byte("garbage"), 0644))
+	panicOnErr(os.Rename(cached+".tmp", cached))
+	remaining, err := jcache.DrainUploads(c.basePath, cfg.Tiers, c.logger, true)
+	panicOnErr(err)
+	if remaining != 0 {
+		t.Fatalf("remaining=%d", remaining)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(sharedDir, first.Key, "classes", "jcache", "EmptyTopLevelClass.class"))
+	panicOnErr(err)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("uploaded the entry as modified after queueing")
+	}
+	if snapshots, _ := ioutil.ReadDir(filepath.Join(c.basePath, "uploads", "snapshots")); len(snapshots) > 0 {
+		t.Fatalf("snapshots left behind: %v", snapshots)
+	}
+
+	// a full queue drops the upload queued first, although an upload
+	// queued later is due earlier
+	sources := append(c.copySources("EmptyTopLevelClass", "RawType"), testSource("RawType"))
+	var keys []string
+	for _, src := range sources {
+		c.execute(cfg, src)
+		pending, err = jcache.PendingUploads(c.basePath)
+		panicOnErr(err)
+		for _, up := range pending {
+			if !contains(keys, up.Key) {
+				keys = append(keys, up.Key)
+			}
+		}
+		if len(keys) == 1 {
+			c.deferUpload(keys[0])
+		}
+	}
+	pending, err = jcache.PendingUploads(c.basePath)
+	panicOnErr(err)
+	var queued []string
+	for _, up := range pending {
+		queued = append(queued, up.Key)
+	}
+	if len(queued) != 2 || contains(queued, keys[0]) {
+		t.Fatalf("queued=%v keys=%v", queued, keys)
+	}
+}
+
+func TestRestoreStrategies(t *testing.T) {
+	c := newCacheTest(t)
+	out := filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class")
+
+	// another source of the same class, compiling to different bytes
+	data, err := ioutil.ReadFile(testSource("EmptyTopLevelClass"))
+	panicOnErr(err)
+	shifted := c.path("shifted", "EmptyTopLevelClass.java")
+	panicOnErr(os.MkdirAll(filepath.Dir(shifted), os.ModePerm))
+	panicOnErr(ioutil.WriteFile(shifted, append([]byte("// shifted\n"), data...), 0644))
+
+	// writing over outputs hard linked to the cache must not change the
+	// cached files
+	c.execute(jcache.Config{RestoreStrategy: jcache.RestoreHardlink})
+	cached := filepath.Join(c.entry(), "classes/jcache/EmptyTopLevelClass.class")
+	want, err := ioutil.ReadFile(cached)
+	panicOnErr(err)
+	for _, strategy := range []string{jcache.RestoreCopy, jcache.RestoreCopyFileRange, jcache.RestoreReflink} {
+		c.execute(jcache.Config{RestoreStrategy: jcache.RestoreHardlink})
+		c.execute(jcache.Config{RestoreStrategy: strategy}, shifted)
+		got, err := ioutil.ReadFile(cached)
+		panicOnErr(err)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s wrote through a hard link into the cache", strategy)
+		}
+		if restored, _ := ioutil.ReadFile(out); bytes.Equal(restored, want) {
+			t.Fatalf("%s did not restore", strategy)
+		}
+	}
+
+	// failures other than an unsupported filesystem fail the restore
+	// instead of falling back to the next strategy
+	panicOnErr(os.Remove(out))
+	panicOnErr(os.MkdirAll(filepath.Join(out, "blocker"), os.ModePerm))
+	var buf bytes.Buffer
+	c.logger = jcache.NewHandlerLogger(slog.NewTextHandler(&buf, nil))
+	if _, err := c.run(jcache.Config{RestoreStrategy: jcache.RestoreCopyFileRange}); err == nil {
+		t.Fatalf("restored over a directory")
+	}
+	if strings.Contains(buf.String(), "fell back") {
+		t.Fatalf("fell back on a failure of the filesystem:\n%s", buf.String())
+	}
+}
+
+func TestSkipIdentical(t *testing.T) {
+	c := newCacheTest(t)
+	sources := []string{testSource("EmptyTopLevelClass"), testSource("RawType")}
+	c.execute(jcache.Config{SkipIdentical: true}, sources...)
+
+	identical := filepath.Join(c.outDir, "jcache", "RawType.class")
+	changed := filepath.Join(c.outDir, "jcache", "EmptyTopLevelClass.class")
+	want, err := ioutil.ReadFile(changed)
+	panicOnErr(err)
+	panicOnErr(ioutil.WriteFile(changed, []byte("changed"), 0644))
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, path := range []string{identical, changed} {
+		panicOnErr(os.Chtimes(path, past, past))
+	}
+	before, err := os.Stat(identical)
+	panicOnErr(err)
+
+	report := jcache.NewReport("")
+	c.execute(jcache.Config{SkipIdentical: true, Report: report}, sources...)
+	if c.compiled || report.RestoredFiles != 1 || report.SkippedFiles != 1 {
+		t.Fatalf("compiled=%v restored=%d skipped=%d", c.compiled, report.RestoredFiles, report.SkippedFiles)
+	}
+	after, err := os.Stat(identical)
+	panicOnErr(err)
+	if !os.SameFile(before, after) || !after.ModTime().Equal(past) {
+		t.Fatalf("identical output rewritten")
+	}
+	if got, err := ioutil.ReadFile(changed); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("changed output not restored")
+	}
+
+	// without skipping, every output is written
+	report = jcache.NewReport("")
+	c.execute(jcache.Config{Report: report}, sources...)
+	if report.RestoredFiles != 2 || report.SkippedFiles != 0 {
+		t.Fatalf("restored=%d skipped=%d", report.RestoredFiles, report.SkippedFiles)
+	}
+	if after, err = os.Stat(identical); err != nil || after.ModTime().Equal(past) {
+		t.Fatalf("output not rewritten")
+	}
+}
+
+func TestRemoveStaleOutputs(t *testing.T) {
+	c := newCacheTest(t)
+	foreign := filepath.Join(c.outDir, "foreign.txt")
+	panicOnErr(os.MkdirAll(c.outDir, os.ModePerm))
+	panicOnErr(ioutil.WriteFile(foreign, nil, 0644))
+
+	cfg := jcache.Config{RemoveStale: true}
+	c.execute(cfg, testSource("EmptyTopLevelClass"), testSource("RawType"))
+	if jcache.DoesNotExist(filepath.Join(c.outDir, "jcache/RawType.class")) {
+		t.Fatalf("class file not restored")
+	}
+
+	// RawType.java was deleted
+	c.execute(cfg, testSource("EmptyTopLevelClass"))
+	if !jcache.DoesNotExist(filepath.Join(c.outDir, "jcache/RawType.class")) {
+		t.Fatalf("stale class file not removed")
+	}
+	if jcache.DoesNotExist(filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class")) {
+		t.Fatalf("class file removed")
+	}
+	if jcache.DoesNotExist(foreign) {
+		t.Fatalf("file not written by jcache removed")
+	}
+}
+
+func TestRemoveStaleOutputsSharedDir(t *testing.T) {
+	c := newCacheTest(t)
+	cfg := jcache.Config{RemoveStale: true}
+	empty := filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class")
+	raw := filepath.Join(c.outDir, "jcache/RawType.class")
+
+	// two builds with different flags restore to the same directory
+	c.execute(cfg, testSource("EmptyTopLevelClass"))
+	c.flags = []string{"-nowarn"}
+	c.execute(cfg, testSource("RawType"))
+	c.flags = nil
+	c.execute(cfg, testSource("EmptyTopLevelClass"))
+	if jcache.DoesNotExist(empty) || jcache.DoesNotExist(raw) {
+		t.Fatalf("removed the outputs of another build")
+	}
+
+	// a build still replaces its own outputs
+	c.flags = []string{"-nowarn"}
+	c.execute(cfg, testSource("EmptyTopLevelClass"))
+	if !jcache.DoesNotExist(raw) || jcache.DoesNotExist(empty) {
+		t.Fatalf("stale output of the build not removed")
+	}
+}
+
+func TestModifiedSourceAfterTouchedSource(t *testing.T) {
+	c := newCacheTest(t)
+	sources := c.copySources("EmptyTopLevelClass", "RawType")
+
+	c.execute(jcache.Config{}, sources...)
+
+	// touch the first source, modify the second one
+	past := time.Now().Add(-time.Hour)
+	panicOnErr(os.Chtimes(sources[0], past, past))
+	f, err := os.OpenFile(sources[1], os.O_APPEND|os.O_WRONLY, 0)
+	panicOnErr(err)
+	_, err = f.WriteString("// modified\n")
+	f.Close()
+	panicOnErr(err)
+
+	c.execute(jcache.Config{}, sources...)
+	if !c.compiled {
+		t.Fatalf("modified source served from the cache")
+	}
+}
+
+func TestRacySourceVerified(t *testing.T) {
+	c := newCacheTest(t)
+	sources := c.copySources("RawType")
+	// modify changes the source, keeping its size and mtime
+	modify := func() {
+		stat, err := os.Stat(sources[0])
+		panicOnErr(err)
+		data, err := ioutil.ReadFile(sources[0])
+		panicOnErr(err)
+		if bytes.Contains(data, []byte("List<String>")) {
+			data = bytes.Replace(data, []byte("List<String>"), []byte("List<Object>"), 1)
+		} else {
+			data = bytes.Replace(data, []byte("List<Object>"), []byte("List<String>"), 1)
+		}
+		panicOnErr(ioutil.WriteFile(sources[0], data, 0644))
+		panicOnErr(os.Chtimes(sources[0], stat.ModTime(), stat.ModTime()))
+	}
+
+	// recorded right after being written, without a change time to tell
+	// a later modification apart
+	c.execute(jcache.Config{}, sources...)
+	sourceInfoPath := filepath.Join(c.entry(), "source-info.json")
+	infoSlice, err := jcache.UnmarshalFileInfoSlice(sourceInfoPath)
+	panicOnErr(err)
+	for i := range infoSlice {
+		infoSlice[i].ChangeTime = time.Time{}
+	}
+	panicOnErr(jcache.MarshalFileInfoSlice(infoSlice, sourceInfoPath))
+	modify()
+	c.execute(jcache.Config{}, sources...)
+	if !c.compiled {
+		t.Fatalf("source modified within the racy window served from the cache")
+	}
+
+	// recorded long after being written, touching it is a hit
+	past := time.Now().Add(-time.Hour)
+	panicOnErr(os.Chtimes(sources[0], past, past))
+	c.execute(jcache.Config{}, sources...)
+	if c.compiled {
+		t.Fatalf("touched source not served from the cache")
+	}
+	infoSlice, err = jcache.UnmarshalFileInfoSlice(sourceInfoPath)
+	panicOnErr(err)
+	if !infoSlice[0].ModTime.Equal(past) {
+		t.Fatalf("record of the touched source not refreshed")
+	}
+
+	// only the change time tells the modification apart
+	modify()
+	c.execute(jcache.Config{}, sources...)
+	if !c.compiled {
+		t.Fatalf("source with a changed ctime served from the cache")
+	}
+}
+
+func TestSourceChangedWhileHashed(t *testing.T) {
+	c := newCacheTest(t)
+	sources := c.copySources("RawType")
+	f, err := os.OpenFile(sources[0], os.O_APPEND|os.O_WRONLY, 0)
+	panicOnErr(err)
+	defer f.Close()
+	_, err = f.WriteString(strings.Repeat("// padding to slow down hashing\n", 1<<19))
+	panicOnErr(err)
+
+	// keep appending while jcache runs, backdating the source so that
+	// only the change itself keeps its digest from being cached
+	past := time.Now().Add(-time.Hour)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			f.WriteString("//\n")
+			os.Chtimes(sources[0], past, past)
+		}
+	}()
+	c.run(jcache.Config{}, sources...)
+	close(done)
+	<-stopped
+
+	file, err := os.Open(filepath.Join(c.basePath, "digests.json"))
+	if os.IsNotExist(err) {
+		return
+	}
+	panicOnErr(err)
+	defer file.Close()
+	var entries map[string]struct {
+		Stamp  struct{ Size int64 }
+		Digest string
+	}
+	panicOnErr(jcache.NewDecoder(file).Decode(&entries))
+
+	// the source only grew, its content at any size is a prefix of what
+	// it ended up with
+	data, err := ioutil.ReadFile(sources[0])
+	panicOnErr(err)
+	for key, e := range entries {
+		if !strings.HasSuffix(key, sources[0]) {
+			continue
+		}
+		prefix := c.path("prefix")
+		panicOnErr(ioutil.WriteFile(prefix, data[:e.Stamp.Size], 0644))
+		if digest, err := jcache.HashFile(prefix, jcache.DefaultHashAlgo); err != nil || digest != e.Digest {
+			t.Fatalf("cached the digest of a source changed while hashed: %s", key)
+		}
+	}
+}
+
+func TestGitFingerprints(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	c := newCacheTest(t)
+	repo := c.path("repo")
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@test"}, args...)...)
+		out, err := cmd.Output()
+		panicOnErr(err)
+		return strings.TrimSpace(string(out))
+	}
+	panicOnErr(os.MkdirAll(repo, 0755))
+	git("init", "-q")
+	tracked := c.copySources("RawType")[0]
+	untracked := c.copySources("EmptyTopLevelClass")[0]
+	panicOnErr(os.Rename(tracked, filepath.Join(repo, "RawType.java")))
+	tracked = filepath.Join(repo, "RawType.java")
+	git("add", "RawType.java")
+	git("commit", "-q", "-m", "initial")
+
+	cfg := jcache.Config{GitFingerprints: true}
+	// recorded returns the digests recorded for the sources of the entry
+	recorded := func() map[string]jcache.Digest {
+		infoSlice, err := jcache.UnmarshalFileInfoSlice(filepath.Join(c.entry(), "source-info.json"))
+		panicOnErr(err)
+		digests := make(map[string]jcache.Digest)
+		for _, info := range infoSlice {
+			digests[info.Path] = info.Digest
+		}
+		return digests
+	}
+
+	c.execute(cfg, tracked, untracked)
+	digests := recorded()
+	if d := digests[tracked]; d.Algo != jcache.DigestGitBlob || d.Value != git("rev-parse", ":RawType.java") {
+		t.Fatalf("clean source digest=%v", d)
+	}
+	if d := digests[untracked]; d.Algo != jcache.DefaultHashAlgo {
+		t.Fatalf("source outside of git digest=%v", d)
+	}
+
+	// entries recorded with git blobs are validated by them, whatever the
+	// configuration
+	panicOnErr(os.RemoveAll(c.outDir))
+	c.execute(jcache.Config{}, tracked, untracked)
+	if c.compiled {
+		t.Fatalf("git fingerprinted entry not served from the cache")
+	}
+
+	// dirty sources are hashed by jcache, as git would
+	f, err := os.OpenFile(tracked, os.O_APPEND|os.O_WRONLY, 0)
+	panicOnErr(err)
+	_, err = f.WriteString("// modified\n")
+	f.Close()
+	panicOnErr(err)
+	c.execute(cfg, tracked, untracked)
+	if !c.compiled {
+		t.Fatalf("dirty source served from the cache")
+	}
+	if d := recorded()[tracked]; d.Algo != jcache.DigestGitBlob || d.Value != git("hash-object", "RawType.java") {
+		t.Fatalf("dirty source digest=%v", d)
+	}
+
+	// clean sources are not read, git is trusted even with files it was
+	// told to assume unchanged
+	git("add", "RawType.java")
+	git("update-index", "--assume-unchanged", "RawType.java")
+	f, err = os.OpenFile(tracked, os.O_APPEND|os.O_WRONLY, 0)
+	panicOnErr(err)
+	_, err = f.WriteString("// modified again\n")
+	f.Close()
+	panicOnErr(err)
+	c.execute(cfg, tracked, untracked)
+	if c.compiled {
+		t.Fatalf("source assumed unchanged not served from the cache")
+	}
+	if d := recorded()[tracked]; d.Value != git("rev-parse", ":RawType.java") || d.Value == git("hash-object", "RawType.java") {
+		t.Fatalf("source assumed unchanged digest=%v", d)
+	}
+}
+
+func TestMigrateLegacyEntry(t *testing.T) {
+	c := newCacheTest(t)
+	c.execute(jcache.Config{})
+
+	// rewrite the entry the way format 0 recorded it
+	entry := c.entry()
+	sourceInfoPath := filepath.Join(entry, "source-info.json")
+	infoSlice, err := jcache.UnmarshalFileInfoSlice(sourceInfoPath)
+	panicOnErr(err)
+	var legacy []map[string]interface{}
+	for _, info := range infoSlice {
+		legacy = append(legacy, map[string]interface{}{
+			"Path":    info.Path,
+			"ModTime": info.ModTime,
+			"Sha256":  info.Digest.Value,
+		})
+	}
+	data, err := json.Marshal(legacy)
+	panicOnErr(err)
+	panicOnErr(ioutil.WriteFile(sourceInfoPath, data, 0644))
+	panicOnErr(os.Remove(filepath.Join(entry, "format.json")))
+
+	c.execute(jcache.Config{})
+	if c.compiled {
+		t.Fatalf("legacy entry not migrated")
+	}
+	format, err := jcache.UnmarshalEntryFormat(filepath.Join(entry, "format.json"))
+	panicOnErr(err)
+	if format.Version != jcache.FormatVersion {
+		t.Fatalf("version=%d", format.Version)
+	}
+}
+
+func TestCorruptEntryRecompiled(t *testing.T) {
+	c := newCacheTest(t)
+	cfg := jcache.Config{RestoreVerify: true}
+	c.execute(cfg)
+	want, err := ioutil.ReadFile(filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class"))
+	panicOnErr(err)
+
+	cached := filepath.Join(c.entry(), "classes", "jcache", "EmptyTopLevelClass.class")
+	panicOnErr(ioutil.WriteFile(cached, []byte("garbage"), 0644))
+	panicOnErr(os.RemoveAll(c.outDir))
+
+	c.execute(cfg)
+	if !c.compiled {
+		t.Fatalf("corrupt entry served from the cache")
+	}
+	got, err := ioutil.ReadFile(filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class"))
+	panicOnErr(err)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("corrupt class file restored")
+	}
+	if jcache.DoesNotExist(filepath.Join(c.basePath, "quarantine")) {
+		t.Fatalf("corrupt entry not quarantined")
+	}
+}
+
+func TestParallelRestore(t *testing.T) {
+	for _, layout := range []string{jcache.LayoutTree, jcache.LayoutObjects} {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/%d", layout, workers), func(t *testing.T) {
+				c := newCacheTest(t)
+				var sources []string
+				for i := 0; i < 32; i++ {
+					src := c.path(fmt.Sprintf("C%d.java", i))
+					code := fmt.Sprintf("package p%d;\nclass C%d {}\n", i%8, i)
+					panicOnErr(ioutil.WriteFile(src, []byte(code), 0644))
+					sources = append(sources, src)
+				}
+				cfg := jcache.Config{Layout: layout, IOConcurrency: workers, Fsync: jcache.FsyncAll}
+				c.execute(cfg, sources...)
+				compiled := c.outputs()
+				if len(compiled) != len(sources) {
+					t.Fatalf("compiled %d classes", len(compiled))
+				}
+
+				panicOnErr(os.RemoveAll(c.outDir))
+				c.execute(cfg, sources...)
+				if c.compiled {
+					t.Fatalf("not restored from the cache")
+				}
+				restored := c.outputs()
+				for rel, data := range compiled {
+					if restored[rel] != data {
+						t.Fatalf("%s not restored", rel)
+					}
+				}
+
+				stats, err := jcache.LoadStats(c.basePath)
+				panicOnErr(err)
+				for _, phase := range []string{"restore.mkdir", "restore.copy", "restore.fsync"} {
+					if _, ok := stats.Phases[phase]; !ok {
+						t.Fatalf("phase %s not timed: %v", phase, stats.Phases)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRestoreVerifyDefault(t *testing.T) {
+	c := newCacheTest(t)
+	cwd, err := os.Getwd()
+	panicOnErr(err)
+	t.Cleanup(func() { loadConf(cwd) })
+	t.Setenv("XDG_CONFIG_HOME", c.path("config"))
+	t.Setenv("JCACHE_PATH", c.basePath)
+	loadConf(c.tmpDir)
+	if !restoreVerify {
+		t.Fatalf("restore_verify off by default")
+	}
+
+	// sizes are checked even without verification
+	c.execute(jcache.Config{})
+	cached := filepath.Join(c.entry(), "classes", "jcache", "EmptyTopLevelClass.class")
+	panicOnErr(ioutil.WriteFile(cached, []byte("garbage"), 0644))
+	panicOnErr(os.RemoveAll(c.outDir))
+	c.execute(jcache.Config{})
+	if !c.compiled {
+		t.Fatalf("truncated entry served from the cache")
+	}
+
+	// content is checked by default
+	cfg := jcache.Config{RestoreVerify: restoreVerify}
+	cached = filepath.Join(c.entry(), "classes", "jcache", "EmptyTopLevelClass.class")
+	data, err := ioutil.ReadFile(cached)
+	panicOnErr(err)
+	data[len(data)-1] ^= 0xff
+	panicOnErr(ioutil.WriteFile(cached, data, 0644))
+	panicOnErr(os.RemoveAll(c.outDir))
+	c.execute(cfg)
+	if !c.compiled {
+		t.Fatalf("corrupt entry of the right size served from the cache")
+	}
+}
+
+func TestRestoreMTime(t *testing.T) {
+	c := newCacheTest(t)
+	sources := c.copySources("EmptyTopLevelClass")
+	out := filepath.Join(c.outDir, "jcache", "EmptyTopLevelClass.class")
+	c.execute(jcache.Config{}, sources...)
+	stat, err := os.Stat(filepath.Join(c.entry(), "classes", "jcache", "EmptyTopLevelClass.class"))
+	panicOnErr(err)
+	compiled := stat.ModTime()
+	newest := compiled.Add(-2 * time.Hour).Truncate(time.Second)
+	panicOnErr(os.Chtimes(sources[0], newest, newest))
+
+	for _, test := range []struct {
+		cfg  jcache.Config
+		want time.Time
+	}{
+		{jcache.Config{RestoreMTime: jcache.MTimePreserve}, compiled},
+		{jcache.Config{RestoreMTime: jcache.MTimeSourceDateEpoch, SourceDateEpoch: newest}, newest},
+		{jcache.Config{RestoreMTime: jcache.MTimeSourceDateEpoch, SourceDateEpoch: compiled.Add(time.Hour)}, compiled},
+		{jcache.Config{RestoreMTime: jcache.MTimeNewestSource}, newest},
+	} {
+		panicOnErr(os.RemoveAll(c.outDir))
+		c.execute(test.cfg, sources...)
+		stat, err := os.Stat(out)
+		panicOnErr(err)
+		if c.compiled || !stat.ModTime().Equal(test.want) {
+			t.Fatalf("%s: compiled=%v mtime=%v, want %v", test.cfg.RestoreMTime, c.compiled, stat.ModTime(), test.want)
+		}
+	}
+
+	panicOnErr(os.RemoveAll(c.outDir))
+	c.execute(jcache.Config{RestoreMTime: jcache.MTimeNow}, sources...)
+	if stat, err = os.Stat(out); err != nil || !stat.ModTime().After(compiled) {
+		t.Fatalf("restored with mtime %v", stat.ModTime())
+	}
+}
+
+func TestSourceDateEpochUnset(t *testing.T) {
+	c := newCacheTest(t)
+	cwd, err := os.Getwd()
+	panicOnErr(err)
+	t.Cleanup(func() { loadConf(cwd) })
+	t.Setenv("XDG_CONFIG_HOME", c.path("config"))
+	t.Setenv("JCACHE_RESTORE_MTIME", jcache.MTimeSourceDateEpoch)
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	loadConf(c.tmpDir)
+	if restoreMTime != jcache.MTimeNow || len(conf.Errors()) != 1 {
+		t.Fatalf("policy=%s errors=%v", restoreMTime, conf.Errors())
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "315532800")
+	loadConf(c.tmpDir)
+	if restoreMTime != jcache.MTimeSourceDateEpoch || !sourceDateEpoch.Equal(time.Unix(315532800, 0)) || len(conf.Errors()) != 0 {
+		t.Fatalf("policy=%s epoch=%v errors=%v", restoreMTime, sourceDateEpoch, conf.Errors())
+	}
+}
+
+func TestRestoreMode(t *testing.T) {
+	c := newCacheTest(t)
+	out := filepath.Join(c.outDir, "jcache", "EmptyTopLevelClass.class")
+	jc, err := jcache.NewCacheWithConfig(
+		jcache.Config{BasePath: c.basePath},
+		func(name string, args ...string) (*jcache.ExecInfo, error) {
+			info, err := jcache.Command(name, args...)
+			compiled, _ := filepath.Glob(filepath.Join(c.basePath, "*", "classes", "jcache", "*.class"))
+			for _, path := range compiled {
+				panicOnErr(os.Chmod(path, 0755))
+			}
+			return info, err
+		},
+		c.logger,
+		asSlice(findJavac(), "-d", c.outDir, testSource("EmptyTopLevelClass")),
+	)
+	panicOnErr(err)
+	_, err = jc.Execute()
+	panicOnErr(err)
+
+	panicOnErr(os.RemoveAll(c.outDir))
+	c.execute(jcache.Config{})
+	stat, err := os.Stat(out)
+	panicOnErr(err)
+	if c.compiled || stat.Mode().Perm() != 0755 {
+		t.Fatalf("compiled=%v mode=%v", c.compiled, stat.Mode())
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	c := newCacheTest(t)
+	for _, level := range []int{-1, 10} {
+		if _, err := c.run(jcache.Config{Compression: jcache.CompressionGzip, CompressionLevel: level}); err == nil {
+			t.Fatalf("accepted level %d", level)
+		}
+	}
+	for _, s := range []string{"0", "10", "fast"} {
+		if _, err := jcache.ParseCompressionLevel(s); err == nil {
+			t.Fatalf("parsed level %s", s)
+		}
+	}
+
+	// levels trade size for speed
+	var sizes []int64
+	for _, level := range []string{"1", "9"} {
+		l, err := jcache.ParseCompressionLevel(level)
+		panicOnErr(err)
+		c.basePath = c.path("cache" + level)
+		c.execute(jcache.Config{Compression: jcache.CompressionGzip, CompressionLevel: l}, testSource("RawType"))
+		si, err := jcache.UnmarshalStorageInfo(filepath.Join(c.entry(), "storage-info.json"))
+		panicOnErr(err)
+		if si.Compression != jcache.CompressionGzip {
+			t.Fatalf("compression=%s", si.Compression)
+		}
+		sizes = append(sizes, si.StoredBytes)
+	}
+	if sizes[1] > sizes[0] {
+		t.Fatalf("level 9 stored %d bytes, level 1 %d", sizes[1], sizes[0])
+	}
+}
+
+func TestListShow(t *testing.T) {
+	c := newCacheTest(t)
+	c.execute(jcache.Config{Layout: jcache.LayoutObjects, Version: "test"}, testSource("RawType"))
+	c.execute(jcache.Config{Version: "test"})
+	c.execute(jcache.Config{Version: "test"})
+
+	entries, err := jcache.ListEntries(c.basePath)
+	panicOnErr(err)
+	if len(entries) != 2 {
+		t.Fatalf("entries=%v", entries)
+	}
+	// newest first
+	e := entries[0]
+	if e.Usage.Hits != 1 || e.StoredBytes == 0 || e.SourceDir != filepath.Dir(testSource("EmptyTopLevelClass")) {
+		t.Fatalf("entry=%+v", e)
+	}
+	if e.Info.Version != "test" || e.Info.Host == "" || e.Info.User == "" || e.Info.Args[0] != findJavac() {
+		t.Fatalf("provenance=%+v", e.Info)
+	}
+	if entries[1].Usage.Hits != 0 {
+		t.Fatalf("entry=%+v", entries[1])
+	}
+
+	d, err := jcache.ShowEntry(c.basePath, entries[1].Key[:8])
+	panicOnErr(err)
+	if d.Key != entries[1].Key || d.Storage.Layout != jcache.LayoutObjects {
+		t.Fatalf("details=%+v", d)
+	}
+	if len(d.Sources) != 1 || d.Sources[0].Path != testSource("RawType") {
+		t.Fatalf("sources=%v", d.Sources)
+	}
+	if len(d.Outputs) != 1 || d.Outputs[0] != "classes/jcache/RawType.class" {
+		t.Fatalf("outputs=%v", d.Outputs)
+	}
+	if d.Exec.Exit != 0 || !strings.Contains(d.Exec.Stderr, "warning") {
+		t.Fatalf("exec=%+v", d.Exec)
+	}
+
+	if _, err = jcache.ShowEntry(c.basePath, ""); err == nil {
+		t.Fatalf("ambiguous key accepted")
+	}
+	if _, err = jcache.ShowEntry(c.basePath, "zz"); err == nil {
+		t.Fatalf("unknown key accepted")
+	}
+}
+
+func TestHandlerLogger(t *testing.T) {
+	c := newCacheTest(t)
+	var buf bytes.Buffer
+	c.logger = jcache.NewHandlerLogger(slog.NewJSONHandler(&buf, nil))
+	c.execute(jcache.Config{})
+	c.execute(jcache.Config{})
+
+	outcomes := make(map[string]string)
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var record map[string]interface{}
+		panicOnErr(dec.Decode(&record))
+		if record["key"] == nil || record["invocation"] == nil {
+			t.Fatalf("record lacks key or invocation: %v", record)
+		}
+		if outcome, ok := record["outcome"].(string); ok {
+			outcomes[record["invocation"].(string)] = outcome
+		}
+	}
+	var got []string
+	for _, outcome := range outcomes {
+		got = append(got, outcome)
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "hit,miss" {
+		t.Fatalf("outcomes=%v", got)
+	}
+}
+
+func TestReport(t *testing.T) {
+	c := newCacheTest(t)
+	reportPath := c.path("report.jsonl")
+	for i := 0; i < 2; i++ {
+		report := jcache.NewReport("test")
+		c.execute(jcache.Config{Report: report})
+		panicOnErr(jcache.AppendReport(reportPath, report))
+	}
+
+	file, err := os.Open(reportPath)
+	panicOnErr(err)
+	defer file.Close()
+	var reports []jcache.Report
+	dec := json.NewDecoder(file)
+	for dec.More() {
+		var r jcache.Report
+		panicOnErr(dec.Decode(&r))
+		reports = append(reports, r)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("reports=%v", reports)
+	}
+	miss, hit := reports[0], reports[1]
+	if miss.Outcome != jcache.OutcomeMiss || miss.Reason != "no entry" || hit.Outcome != jcache.OutcomeHit {
+		t.Fatalf("outcomes=%s (%s), %s", miss.Outcome, miss.Reason, hit.Outcome)
+	}
+	if hit.Key != miss.Key || hit.Sources != 1 || hit.Tag != "test" || hit.Phases["lookup"] == 0 {
+		t.Fatalf("hit=%+v", hit)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	c := newCacheTest(t)
+
+	// stands in for an OpenTelemetry collector
+	type span struct {
+		TraceID      string
+		SpanID       string
+		ParentSpanID string
+		Name         string
+	}
+	var spans []span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span
+				}
+			}
+		}
+		panicOnErr(json.NewDecoder(r.Body).Decode(&req))
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	traceID, parentID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tracer := jcache.NewTracer(jcache.TraceConfig{
+		Endpoint:    collector.URL + "/v1/traces",
+		Traceparent: "00-" + traceID + "-" + parentID + "-01",
+	})
+	c.execute(jcache.Config{Tracer: tracer})
+	panicOnErr(tracer.Export())
+
+	var root span
+	names := make(map[string]bool)
+	for _, s := range spans {
+		if s.TraceID != traceID {
+			t.Fatalf("span %s of trace %s", s.Name, s.TraceID)
+		}
+		if s.Name == "jcache" {
+			root = s
+		}
+		names[s.Name] = true
+	}
+	if root.ParentSpanID != parentID {
+		t.Fatalf("root span parent=%q", root.ParentSpanID)
+	}
+	for _, name := range []string{"lookup", "hash", "compile", "store", "restore"} {
+		if !names[name] {
+			t.Fatalf("no %s span in %v", name, names)
+		}
+	}
+	for _, s := range spans {
+		if s.Name != "jcache" && s.ParentSpanID != root.SpanID {
+			t.Fatalf("span %s not nested under the root", s.Name)
+		}
+	}
+}
+
+func TestPruneObjects(t *testing.T) {
+	c := newCacheTest(t)
+	cfg := jcache.Config{Layout: jcache.LayoutObjects}
+	c.execute(cfg, testSource("RawType"))
+	removed, err := jcache.UnmarshalManifest(filepath.Join(c.entry(), "manifest.json"))
+	panicOnErr(err)
+	panicOnErr(os.RemoveAll(c.entry()))
+	c.execute(cfg)
+	kept, err := jcache.UnmarshalManifest(filepath.Join(c.entry(), "manifest.json"))
+	panicOnErr(err)
+
+	// age all objects beyond the grace period, then add one being stored
+	objects := filepath.Join(c.basePath, "objects")
+	past := time.Now().Add(-2 * time.Hour)
+	panicOnErr(filepath.Walk(objects, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			err = os.Chtimes(path, past, past)
+		}
+		return err
+	}))
+	fresh := filepath.Join(objects, "00", strings.Repeat("0", 64))
+	panicOnErr(os.MkdirAll(filepath.Dir(fresh), 0755))
+	panicOnErr(ioutil.WriteFile(fresh, []byte("fresh"), 0644))
+
+	nObjects, nBytes, err := jcache.PruneObjects(c.basePath)
+	panicOnErr(err)
+	if nObjects != len(removed) || nBytes == 0 {
+		t.Fatalf("removed %d objects (%d bytes), want %d", nObjects, nBytes, len(removed))
+	}
+	for _, me := range removed {
+		if !jcache.DoesNotExist(filepath.Join(objects, me.Object[:2], me.Object)) {
+			t.Fatalf("unreferenced object %s not removed", me.Object)
+		}
+	}
+	if jcache.DoesNotExist(fresh) {
+		t.Fatalf("object within the grace period removed")
+	}
+
+	panicOnErr(os.RemoveAll(c.outDir))
+	c.execute(cfg)
+	if c.compiled {
+		t.Fatalf("entry not restored after pruning")
+	}
+	for _, me := range kept {
+		if jcache.DoesNotExist(filepath.Join(c.outDir, strings.TrimPrefix(me.Path, "classes/"))) {
+			t.Fatalf("%s not restored", me.Path)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	c := newCacheTest(t)
+	c.execute(jcache.Config{Layout: jcache.LayoutObjects, Namespace: "a"}, testSource("RawType"))
+	c.execute(jcache.Config{Namespace: "b"})
+
+	archive := c.path("cache.tar.gz")
+	if tr, err := jcache.Export(c.basePath, archive, jcache.ExportOptions{}); err != nil || tr.Entries != 2 {
+		t.Fatalf("exported %+v, %v", tr, err)
+	}
+	if tr, err := jcache.Export(c.basePath, c.path("a.tar"), jcache.ExportOptions{Namespace: "a"}); err != nil || tr.Entries != 1 {
+		t.Fatalf("exported namespace %+v, %v", tr, err)
+	}
+
+	imported := c.path("imported")
+	if tr, err := jcache.Import(imported, archive); err != nil || tr.Entries != 2 {
+		t.Fatalf("imported %+v, %v", tr, err)
+	}
+	for _, src := range []string{testSource("RawType"), testSource("EmptyTopLevelClass")} {
+		panicOnErr(os.RemoveAll(c.outDir))
+		c.execute(jcache.Config{BasePath: imported}, src)
+		if c.compiled {
+			t.Fatalf("imported entry of %s not served from the cache", src)
+		}
+	}
+	if tr, err := jcache.Import(imported, archive); err != nil || tr.Entries != 0 || tr.Existing != 2 {
+		t.Fatalf("imported again %+v, %v", tr, err)
+	}
+
+	// entries whose objects do not match their manifest are rejected
+	members := readTar(c.path("a.tar"))
+	for i := range members {
+		if strings.HasPrefix(members[i].hdr.Name, "objects/") {
+			members[i].data = append(members[i].data, "tampered"...)
+			members[i].hdr.Size = int64(len(members[i].data))
+		}
+	}
+	writeTar(c.path("tampered.tar"), members)
+	if tr, err := jcache.Import(c.path("tampered"), c.path("tampered.tar")); err != nil || tr.Entries != 0 || tr.Rejected != 1 {
+		t.Fatalf("imported tampered %+v, %v", tr, err)
+	}
+
+	// members outside of the cache fail the import
+	key := strings.SplitN(members[len(members)-1].hdr.Name, "/", 2)[0]
+	for i, hdr := range []*tar.Header{
+		{Name: "../escaped", Typeflag: tar.TypeReg},
+		{Name: key + "/../../escaped", Typeflag: tar.TypeReg},
+		{Name: "/escaped", Typeflag: tar.TypeReg},
+		{Name: key + "/escaped", Typeflag: tar.TypeSymlink, Linkname: "../../escaped"},
+	} {
+		malicious := c.path(fmt.Sprint("malicious", i))
+		writeTar(malicious+".tar", append(members, tarMember{hdr: hdr}))
+		if _, err := jcache.Import(malicious, malicious+".tar"); err == nil {
+			t.Fatalf("imported %s", hdr.Name)
+		}
+		for _, escaped := range []string{c.path("escaped"), filepath.Join(malicious, "escaped")} {
+			if !jcache.DoesNotExist(escaped) {
+				t.Fatalf("%s written to %s", hdr.Name, escaped)
+			}
+		}
+	}
+}
+
+func TestPackedRoundTrip(t *testing.T) {
+	c := newCacheTest(t)
+	sharedDir := c.path("shared")
+	rw, err := jcache.NewDirTier(sharedDir, jcache.TierReadWrite, 0022, "")
+	panicOnErr(err)
+	cfg := jcache.Config{Layout: jcache.LayoutPacked, Tiers: []jcache.Tier{rw}}
+	sources := []string{testSource("EmptyTopLevelClass"), testSource("RawType")}
+	c.execute(cfg, sources...)
+	want := c.outputs()
+
+	// the archive carries the metadata, so the tier holds nothing else
+	infos, err := ioutil.ReadDir(filepath.Join(sharedDir, filepath.Base(c.entry())))
+	panicOnErr(err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if strings.Join(names, " ") != "entry.zip storage-info.json" {
+		t.Fatalf("published %v", names)
+	}
+
+	for _, dir := range []string{c.outDir, c.basePath} {
+		panicOnErr(os.RemoveAll(dir))
+		c.execute(cfg, sources...)
+		if c.compiled {
+			t.Fatalf("not restored without %s", dir)
+		}
+		restored := c.outputs()
+		for rel, data := range want {
+			if restored[rel] != data {
+				t.Fatalf("%s not restored without %s", rel, dir)
+			}
+		}
+	}
+}
+
+func TestEscapingEntryRejected(t *testing.T) {
+	for _, layout := range []string{jcache.LayoutObjects, jcache.LayoutPacked} {
+		t.Run(layout, func(t *testing.T) {
+			c := newCacheTest(t)
+			cfg := jcache.Config{Layout: layout}
+			c.execute(cfg)
+
+			// point a member of the entry outside of the output directory
+			escaped := c.path("escaped.class")
+			member := "classes/../../escaped.class"
+			if layout == jcache.LayoutObjects {
+				manifestPath := filepath.Join(c.entry(), "manifest.json")
+				manifest, err := jcache.UnmarshalManifest(manifestPath)
+				panicOnErr(err)
+				manifest[0].Path = member
+				panicOnErr(jcache.MarshalManifest(manifest, manifestPath))
+			} else {
+				renameZipMembers(filepath.Join(c.entry(), "entry.zip"), member)
+			}
+			panicOnErr(os.RemoveAll(c.outDir))
+
+			c.execute(cfg)
+			if !c.compiled {
+				t.Fatalf("escaping entry served from the cache")
+			}
+			if !jcache.DoesNotExist(escaped) {
+				t.Fatalf("restored outside of the output directory")
+			}
+		})
+	}
+}
+
+func TestInvalidConf(t *testing.T) {
+	c := newCacheTest(t)
+	cwd, err := os.Getwd()
+	panicOnErr(err)
+	t.Cleanup(func() { loadConf(cwd) })
+
+	panicOnErr(ioutil.WriteFile(c.path(".jcache.conf"), []byte("bogus\nrestore_remove_stale = true\nunknown = 1\n"), 0644))
+	t.Setenv("JCACHE_PATH", "")
+	t.Setenv("JCACHE_STORAGE_LAYOUT", "bogus")
+	t.Setenv("JCACHE_VERBOSE", "maybe")
+	loadConf(c.tmpDir)
+
+	if basePath != jcache.DefaultCachePath() {
+		t.Fatalf("basePath=%s", basePath)
+	}
+	// the valid lines of a file survive its invalid ones
+	if layout != jcache.LayoutTree || verbose || !removeStale {
+		t.Fatalf("layout=%s verbose=%v removeStale=%v", layout, verbose, removeStale)
+	}
+	if errs := conf.Errors(); len(errs) != 4 {
+		t.Fatalf("errors=%v", errs)
+	}
+
+	// compiles nevertheless
+	t.Setenv("JCACHE_PATH", c.basePath)
+	loadConf(c.tmpDir)
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = append(asSlice("jcache", findJavac(), "-d", c.outDir), testSource("EmptyTopLevelClass"))
+	if exit := mainExitCode(); exit != ExitSuccess {
+		t.Fatalf("exit=%d", exit)
+	}
+	if jcache.DoesNotExist(filepath.Join(c.outDir, "jcache/EmptyTopLevelClass.class")) {
+		t.Fatalf("not compiled")
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	c := newCacheTest(t)
+	t.Setenv("XDG_CONFIG_HOME", c.path("config"))
+	path := jcache.UserConfPath()
+
+	if exit := setConfig("compression_level=3"); exit != ExitSuccess {
+		t.Fatalf("exit=%d", exit)
+	}
+	stat, err := os.Stat(path)
+	panicOnErr(err)
+	if stat.Mode().Perm() != 0644 {
+		t.Fatalf("created with mode %v", stat.Mode())
+	}
+
+	panicOnErr(ioutil.WriteFile(path, []byte("# tuned\ncompression_level = 3\n"), 0640))
+	panicOnErr(os.Chmod(path, 0640))
+	for _, keyValue := range []string{"compression_level=fast", "restore_verify=maybe", "restore_mtime=never"} {
+		if exit := setConfig(keyValue); exit != ExitErrCli {
+			t.Fatalf("%s: exit=%d", keyValue, exit)
+		}
+	}
+	if exit := setConfig("compression_level = 9"); exit != ExitSuccess {
+		t.Fatalf("exit=%d", exit)
+	}
+	data, err := ioutil.ReadFile(path)
+	panicOnErr(err)
+	stat, err = os.Stat(path)
+	panicOnErr(err)
+	if string(data) != "# tuned\ncompression_level = 9\n" || stat.Mode().Perm() != 0640 {
+		t.Fatalf("mode=%v content=%q", stat.Mode(), data)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	c := newCacheTest(t)
+	path := c.path("abc")
+	panicOnErr(ioutil.WriteFile(path, []byte("abc"), 0644))
+
+	for algo, want := range map[string]string{
+		jcache.DigestSha256:     "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		jcache.DigestSha512_256: "53048e2681941ef99b2e29b76b4c7dabe4c2d0c634fc6d46e0e2f13107e7af23",
+		jcache.DigestBlake3:     "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+		jcache.DigestGitBlob:    "f2ba8f84ab5c1bce84a7b441cb1959cfc7093b7f",
+	} {
+		if got, err := jcache.HashFile(path, algo); err != nil || got != want {
+			t.Errorf("%s=%s, %v", algo, got, err)
+		}
+	}
+	if _, err := jcache.ParseHashAlgo("md5"); err == nil {
+		t.Errorf("accepted md5")
+	}
+}
+
+func TestHashAlgoChanged(t *testing.T) {
+	c := newCacheTest(t)
+	c.execute(jcache.Config{HashAlgo: jcache.DigestSha256})
+
+	// entries of another algorithm are misses
+	for _, algo := range []string{jcache.DigestSha512_256, jcache.DigestBlake3} {
+		panicOnErr(os.RemoveAll(c.outDir))
+		c.execute(jcache.Config{HashAlgo: algo})
+		if !c.compiled {
+			t.Fatalf("entry stored with %s served to %s", jcache.DigestSha256, algo)
+		}
+	}
+
+	panicOnErr(os.RemoveAll(c.outDir))
+	c.execute(jcache.Config{HashAlgo: jcache.DigestSha256})
+	if c.compiled {
+		t.Fatalf("entry stored with %s not served", jcache.DigestSha256)
+	}
+}
+
+func BenchmarkHashFile(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "jcache_bench")
+	panicOnErr(err)
+	defer os.RemoveAll(tmpDir)
+
+	// a typical class file and a large jar-sized file
+	for _, size := range []int{4 << 10, 4 << 20} {
+		path := filepath.Join(tmpDir, fmt.Sprint(size))
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 31)
+		}
+		panicOnErr(ioutil.WriteFile(path, data, 0644))
+
+		for _, algo := range []string{jcache.DigestSha256, jcache.DigestSha512_256, jcache.DigestBlake3} {
+			b.Run(fmt.Sprintf("%s/%d", algo, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, err := jcache.HashFile(path, algo); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
 func systemTest(t *testing.T, fqcn string, pStdout, pStderr func(string) (string, bool), pExit func(int) (string, bool), readErrCmp func(error, error) bool, incErrCmp func(error, error) bool) {
 	tmpDir, err := ioutil.TempDir("", "jcache_test")
 	if err != nil {
@@ -214,3 +1555,263 @@ func findJavac() string {
 	panicOnErr(err)
 	return path
 }
+
+// testSource returns the path of the test class name in package jcache.
+func testSource(name string) string {
+	return "../../test/testdata/java/jcache/" + name + ".java"
+}
+
+// cacheTest runs jcache repeatedly against a cache in a temporary
+// directory, which is removed when the test ends.
+type cacheTest struct {
+	t        *testing.T
+	tmpDir   string
+	basePath string
+	outDir   string
+	logger   jcache.Logger
+	// flags are passed to the compiler before the sources.
+	flags []string
+	// compiled reports whether the last run called the compiler.
+	compiled bool
+}
+
+func newCacheTest(t *testing.T) *cacheTest {
+	tmpDir, err := ioutil.TempDir("", "jcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	return &cacheTest{
+		t:        t,
+		tmpDir:   tmpDir,
+		basePath: filepath.Join(tmpDir, "cache"),
+		outDir:   filepath.Join(tmpDir, "out"),
+		logger:   jcache.NewLogger(os.Stdout),
+	}
+}
+
+// path returns the path of elem inside the temporary directory.
+func (c *cacheTest) path(elem ...string) string {
+	return filepath.Join(append([]string{c.tmpDir}, elem...)...)
+}
+
+// run compiles sources, EmptyTopLevelClass if none, to outDir. cfg uses
+// the test's cache unless it names another one.
+func (c *cacheTest) run(cfg jcache.Config, sources ...string) (*jcache.ExecInfo, error) {
+	if cfg.BasePath == "" {
+		cfg.BasePath = c.basePath
+	}
+	if len(sources) == 0 {
+		sources = []string{testSource("EmptyTopLevelClass")}
+	}
+
+	c.compiled = false
+	jc, err := jcache.NewCacheWithConfig(
+		cfg,
+		func(name string, args ...string) (*jcache.ExecInfo, error) {
+			c.compiled = true
+			return jcache.Command(name, args...)
+		},
+		c.logger,
+		append(append(asSlice(findJavac(), "-d", c.outDir), c.flags...), sources...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return jc.Execute()
+}
+
+func (c *cacheTest) execute(cfg jcache.Config, sources ...string) *jcache.ExecInfo {
+	info, err := c.run(cfg, sources...)
+	panicOnErr(err)
+	return info
+}
+
+// entry returns the path of the only entry of the test's cache.
+func (c *cacheTest) entry() string {
+	entries, err := filepath.Glob(filepath.Join(c.basePath, "*", "compiler-info.json"))
+	panicOnErr(err)
+	if len(entries) != 1 {
+		c.t.Fatalf("entries=%v", entries)
+	}
+	return filepath.Dir(entries[0])
+}
+
+// copySources copies the named test classes into the temporary directory,
+// so that tests can modify them, and returns their paths.
+func (c *cacheTest) copySources(names ...string) []string {
+	var sources []string
+	for _, name := range names {
+		data, err := ioutil.ReadFile(testSource(name))
+		panicOnErr(err)
+		src := c.path(name + ".java")
+		panicOnErr(ioutil.WriteFile(src, data, 0644))
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// outputs returns the content of every file below outDir by its relative
+// path.
+func (c *cacheTest) outputs() map[string]string {
+	files := make(map[string]string)
+	panicOnErr(filepath.Walk(c.outDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		rel, _ := filepath.Rel(c.outDir, path)
+		files[rel] = string(data)
+		return err
+	}))
+	return files
+}
+
+type tarMember struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+func readTar(path string) (members []tarMember) {
+	file, err := os.Open(path)
+	panicOnErr(err)
+	defer file.Close()
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		panicOnErr(err)
+		data, err := ioutil.ReadAll(tr)
+		panicOnErr(err)
+		members = append(members, tarMember{hdr: hdr, data: data})
+	}
+}
+
+func writeTar(path string, members []tarMember) {
+	file, err := os.Create(path)
+	panicOnErr(err)
+	defer file.Close()
+	tw := tar.NewWriter(file)
+	for _, m := range members {
+		panicOnErr(tw.WriteHeader(m.hdr))
+		_, err = tw.Write(m.data)
+		panicOnErr(err)
+	}
+	panicOnErr(tw.Close())
+}
+
+// renameZipMembers rewrites the archive at path, naming its files name.
+func renameZipMembers(path, name string) {
+	zr, err := zip.OpenReader(path)
+	panicOnErr(err)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		r, err := zf.Open()
+		panicOnErr(err)
+		w, err := zw.Create(name)
+		panicOnErr(err)
+		_, err = io.Copy(w, r)
+		r.Close()
+		panicOnErr(err)
+	}
+	zr.Close()
+	panicOnErr(zw.Close())
+	panicOnErr(ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+// snapshot describes the files below root, their sizes and mtimes.
+func (c *cacheTest) snapshot(root string) string {
+	var buf strings.Builder
+	panicOnErr(filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		fmt.Fprintf(&buf, "%s %d %v\n", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	}))
+	return buf.String()
+}
+
+// fakeTier is a remote cache holding no entries. Its requests take delay
+// and fail with err. Requests the breaker gave up on still run, so all
+// fields are guarded by mu.
+type fakeTier struct {
+	mu    sync.Mutex
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (f *fakeTier) set(err error, delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err, f.delay = err, delay
+}
+
+func (f *fakeTier) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// call counts a request and returns how it goes.
+func (f *fakeTier) call() (time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return f.delay, f.err
+}
+
+func (f *fakeTier) Name() string {
+	return "fake"
+}
+
+func (f *fakeTier) Mode() jcache.TierMode {
+	return jcache.TierReadWrite
+}
+
+func (f *fakeTier) Fetch(key, dstPath string) (bool, error) {
+	delay, err := f.call()
+	panicOnErr(os.MkdirAll(dstPath, os.ModePerm))
+	time.Sleep(delay)
+	return false, err
+}
+
+func (f *fakeTier) Store(key, srcPath string) error {
+	delay, err := f.call()
+	time.Sleep(delay)
+	return err
+}
+
+// deferUpload postpones the next attempt of the queued upload of key.
+func (c *cacheTest) deferUpload(key string) {
+	records, err := filepath.Glob(filepath.Join(c.basePath, "uploads", key+"@*.json"))
+	panicOnErr(err)
+	for _, record := range records {
+		var up map[string]interface{}
+		data, err := ioutil.ReadFile(record)
+		panicOnErr(err)
+		panicOnErr(json.Unmarshal(data, &up))
+		up["NextAttempt"] = time.Now().Add(time.Hour).UTC()
+		data, err = json.Marshal(up)
+		panicOnErr(err)
+		panicOnErr(ioutil.WriteFile(record, data, 0644))
+	}
+}
+
+func contains(slice []string, s string) bool {
+	for _, e := range slice {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
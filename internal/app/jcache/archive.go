@@ -0,0 +1,444 @@
+package jcache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// ExportOptions select the entries Export archives. The zero value
+	// selects all of them.
+	ExportOptions struct {
+		// Since selects entries created within this long ago.
+		Since time.Duration
+		// Namespace selects entries stored under this namespace.
+		Namespace string
+	}
+
+	// Transfer summarizes an Export or Import run.
+	Transfer struct {
+		Entries int
+		// Existing counts imported entries already present locally.
+		Existing int
+		// Rejected counts entries failing verification, and imported
+		// entries of a format newer than FormatVersion.
+		Rejected int
+	}
+
+	writeCloser struct {
+		io.Writer
+		closers []func() error
+	}
+	readCloser struct {
+		io.Reader
+		closers []func() error
+	}
+)
+
+func (w *writeCloser) Close() error {
+	return closeAll(w.closers)
+}
+
+func (r *readCloser) Close() error {
+	return closeAll(r.closers)
+}
+
+// closeAll calls all closers in order and returns the first error.
+func closeAll(closers []func() error) (err error) {
+	for _, c := range closers {
+		if cErr := c(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return
+}
+
+// ParseAge parses durations like time.ParseDuration does and additionally
+// accepts a number of days, e.g. 7d.
+func ParseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age: %s", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// archiveCompression derives the compression of the archive at path from
+// its extension. zstd is left to the zstd command.
+func archiveCompression(path string) (string, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar"):
+		return CompressionNone, nil
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return CompressionGzip, nil
+	case strings.HasSuffix(path, ".tar.zst"), strings.HasSuffix(path, ".tzst"):
+		return "zstd", nil
+	}
+	return "", fmt.Errorf("unsupported archive type: %s. use .tar, .tar.gz or .tar.zst", path)
+}
+
+// createArchive creates the archive at path, compressed with the result
+// of archiveCompression.
+func createArchive(path, compression string) (io.WriteCloser, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch compression {
+	case CompressionGzip:
+		zw := gzip.NewWriter(file)
+		return &writeCloser{zw, []func() error{zw.Close, file.Close}}, nil
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = file
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			file.Close()
+			return nil, errors.WithStack(err)
+		}
+		return &writeCloser{stdin, []func() error{stdin.Close, cmd.Wait, file.Close}}, nil
+	}
+	return file, nil
+}
+
+func openArchive(path string) (io.ReadCloser, error) {
+	compression, err := archiveCompression(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch compression {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, errors.WithStack(err)
+		}
+		return &readCloser{zr, []func() error{zr.Close, file.Close}}, nil
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = file
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			file.Close()
+			return nil, errors.WithStack(err)
+		}
+		return &readCloser{stdout, []func() error{cmd.Wait, file.Close}}, nil
+	}
+	return file, nil
+}
+
+// Export writes the complete entries below basePath selected by opts to
+// a tar archive at archivePath, along with the objects they reference.
+// Entries are verified first; corrupt ones are left out.
+func Export(basePath, archivePath string, opts ExportOptions) (t Transfer, err error) {
+	compression, err := archiveCompression(archivePath)
+	if err != nil {
+		return t, err
+	}
+
+	// the archive appears under its name once complete
+	tmpPath := filepath.Join(filepath.Dir(archivePath), "."+filepath.Base(archivePath)+".tmp")
+	out, err := createArchive(tmpPath, compression)
+	if err != nil {
+		return t, err
+	}
+	defer os.Remove(tmpPath)
+
+	tw := tar.NewWriter(out)
+	t, err = exportEntries(tw, basePath, opts)
+	if err == nil {
+		err = errors.WithStack(tw.Close())
+	}
+	if cErr := out.Close(); err == nil {
+		err = errors.WithStack(cErr)
+	}
+	if err != nil {
+		return t, err
+	}
+	return t, errors.WithStack(os.Rename(tmpPath, archivePath))
+}
+
+func exportEntries(tw *tar.Writer, basePath string, opts ExportOptions) (t Transfer, err error) {
+	keys, err := completeEntries(basePath)
+	if err != nil {
+		return t, err
+	}
+
+	objects := make(map[string]error)
+	exported := make(map[string]bool)
+	for _, key := range keys {
+		entryPath := filepath.Join(basePath, key)
+		ei, err := loadEntryInfo(entryPath)
+		if err != nil {
+			return t, errors.WithStack(err)
+		}
+		if opts.Namespace != "" && ei.Namespace != opts.Namespace {
+			continue
+		}
+		if opts.Since > 0 && time.Since(ei.CreatedAt) > opts.Since {
+			continue
+		}
+
+		if err := verifyEntry(entryPath, objects); err != nil {
+			t.Rejected++
+			continue
+		}
+
+		// objects go first, so that importing the entry finds them
+		refs, err := entryObjects(entryPath)
+		if err != nil {
+			return t, err
+		}
+		for _, ref := range refs {
+			if exported[ref] {
+				continue
+			}
+			if err = addToArchive(tw, basePath, ref); err != nil {
+				return t, err
+			}
+			exported[ref] = true
+		}
+
+		err = godirwalk.Walk(entryPath, &godirwalk.Options{
+			Callback: func(src string, de *godirwalk.Dirent) error {
+				if !de.IsRegular() || strings.HasPrefix(de.Name(), ".") {
+					// temp files of a concurrent update
+					return nil
+				}
+				return addToArchive(tw, basePath, src)
+			},
+		})
+		if err != nil {
+			return t, err
+		}
+		t.Entries++
+	}
+	return t, nil
+}
+
+// entryObjects returns the paths of the objects the entry at entryPath
+// references.
+func entryObjects(entryPath string) ([]string, error) {
+	siPath := filepath.Join(entryPath, "storage-info.json")
+	if DoesNotExist(siPath) {
+		return nil, nil
+	}
+	si, err := UnmarshalStorageInfo(siPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if si.Layout != LayoutObjects {
+		return nil, nil
+	}
+	manifest, err := loadManifest(filepath.Join(entryPath, "manifest.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	paths := make([]string, len(manifest))
+	for i, me := range manifest {
+		paths[i] = objectPath(objectsDir(entryPath), me.Object, si.Compression)
+	}
+	return paths, nil
+}
+
+// addToArchive adds the file at path under its basePath relative name.
+// PAX headers keep the sub-second mtime of source-info.json, which
+// validating sources relies on.
+func addToArchive(tw *tar.Writer, basePath, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rel, err := filepath.Rel(basePath, path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(rel),
+		Size:     stat.Size(),
+		Mode:     int64(stat.Mode().Perm()),
+		ModTime:  stat.ModTime(),
+		Format:   tar.FormatPAX,
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(tw, file)
+	return errors.WithStack(err)
+}
+
+// Import merges the entries of the tar archive at archivePath into the
+// cache at basePath. Entries present already are skipped. The others are
+// unpacked next to the cache, migrated to FormatVersion and verified
+// before they, and the objects they reference, are moved into place.
+func Import(basePath, archivePath string) (t Transfer, err error) {
+	in, err := openArchive(archivePath)
+	if err != nil {
+		return t, err
+	}
+	defer in.Close()
+
+	if err = os.MkdirAll(basePath, os.ModePerm); err != nil {
+		return t, errors.WithStack(err)
+	}
+	staging, err := ioutil.TempDir(basePath, ".import-")
+	if err != nil {
+		return t, errors.WithStack(err)
+	}
+	defer os.RemoveAll(staging)
+
+	if err = unpackArchive(tar.NewReader(in), staging); err != nil {
+		return t, err
+	}
+	if err = in.Close(); err != nil {
+		return t, errors.WithStack(err)
+	}
+
+	infos, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return t, errors.WithStack(err)
+	}
+	objects := make(map[string]error)
+	for _, info := range infos {
+		if !info.IsDir() || !isEntryKey(info.Name()) {
+			continue
+		}
+		staged := filepath.Join(staging, info.Name())
+		entryPath := filepath.Join(basePath, info.Name())
+		if !anyNotExists(filepath.Join(entryPath, "source-info.json"),
+			filepath.Join(entryPath, "compiler-info.json")) {
+			t.Existing++
+			continue
+		}
+
+		version, err := entryVersion(staged)
+		if err == nil && version > FormatVersion {
+			err = fmt.Errorf("entry format %d is newer than %d", version, FormatVersion)
+		}
+		if err == nil && version < FormatVersion {
+			err = migrateEntry(staged, version)
+		}
+		if err == nil {
+			err = verifyEntry(staged, objects)
+		}
+		if err != nil {
+			t.Rejected++
+			continue
+		}
+
+		if err = moveImported(staged, entryPath); err != nil {
+			return t, err
+		}
+		t.Entries++
+	}
+	return t, nil
+}
+
+// unpackArchive writes the regular files of tr below dir. Members must be
+// below an entry or the object store; anything else fails the import.
+func unpackArchive(tr *tar.Reader, dir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		top := strings.SplitN(name, "/", 2)[0]
+		if hdr.Typeflag != tar.TypeReg || path.IsAbs(name) || !strings.Contains(name, "/") ||
+			(top != objectsDirName && !isEntryKey(top)) {
+			return fmt.Errorf("unexpected archive member: %s", hdr.Name)
+		}
+
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return errors.WithStack(err)
+		}
+		file, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm()|0200)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = os.Chtimes(dst, hdr.ModTime, hdr.ModTime); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// moveImported moves the verified entry at staged, and the objects it
+// references that are missing locally, into place at entryPath. Objects
+// are moved first, so that the entry is complete once it appears.
+func moveImported(staged, entryPath string) error {
+	refs, err := entryObjects(staged)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		rel, err := filepath.Rel(objectsDir(staged), ref)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dst := filepath.Join(objectsDir(entryPath), rel)
+		if !DoesNotExist(dst) || DoesNotExist(ref) {
+			// present locally, or moved for an earlier entry
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = os.Rename(ref, dst); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// leftovers of an incomplete entry
+	if err = os.RemoveAll(entryPath); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(staged, entryPath))
+}
@@ -0,0 +1,245 @@
+package jcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	breakerLockTimeout = 2 * time.Second
+
+	DefaultRemoteTimeout     = 10 * time.Second
+	DefaultRemoteMaxFailures = 3
+	DefaultRemoteCooldown    = 5 * time.Minute
+)
+
+type (
+	BreakerConfig struct {
+		// Timeout bounds every single Fetch or Store.
+		Timeout time.Duration
+		// MaxFailures consecutive failures open the circuit...
+		MaxFailures int
+		// ...for Cooldown, during which the tier is skipped entirely.
+		Cooldown time.Duration
+		// ReadOnly honors the state but never writes it or the stats,
+		// for read-only caches.
+		ReadOnly bool
+	}
+
+	breakerTier struct {
+		Tier
+		cfg       BreakerConfig
+		basePath  string
+		statePath string
+		log       Logger
+	}
+	breakerState struct {
+		Failures  int
+		OpenUntil time.Time
+	}
+
+	ErrCircuitOpen struct {
+		error
+		Tier  string
+		Until time.Time
+	}
+	ErrTierTimeout struct {
+		error
+		Tier    string
+		Timeout time.Duration
+	}
+)
+
+// NewBreakerTier guards tier with per-request timeouts and a circuit
+// breaker. The breaker state lives below basePath, so that it holds
+// across jcache processes.
+func NewBreakerTier(tier Tier, basePath string, cfg BreakerConfig, logger Logger) Tier {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultRemoteTimeout
+	}
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = DefaultRemoteMaxFailures
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultRemoteCooldown
+	}
+
+	nameSum := sha256.Sum256([]byte(tier.Name()))
+	return &breakerTier{
+		Tier:      tier,
+		cfg:       cfg,
+		basePath:  basePath,
+		statePath: filepath.Join(basePath, "breakers", hex.EncodeToString(nameSum[:8])+".json"),
+		log:       logger,
+	}
+}
+
+func (t *breakerTier) Fetch(key, dstPath string) (bool, error) {
+	if err := t.checkOpen(); err != nil {
+		return false, err
+	}
+
+	// fetch into a scratch directory; a timed out fetch keeps running
+	// and must not write into an entry we are about to compile into.
+	// Scratch directories of processes that exited meanwhile are swept.
+	scratchPath := filepath.Join(filepath.Dir(dstPath), ".fetch")
+	sweepScratch(scratchPath)
+	if err := os.MkdirAll(scratchPath, os.ModePerm); err != nil {
+		return false, errors.WithStack(err)
+	}
+	tmpPath := filepath.Join(scratchPath, uuid.New().String())
+	type result struct {
+		ok  bool
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ok, err := t.Tier.Fetch(key, tmpPath)
+		done <- result{ok, err}
+	}()
+
+	select {
+	case r := <-done:
+		t.record(r.err)
+		if r.err != nil || !r.ok {
+			os.RemoveAll(tmpPath)
+			return false, r.err
+		}
+		os.RemoveAll(dstPath)
+		if err := os.Rename(tmpPath, dstPath); err != nil {
+			os.RemoveAll(tmpPath)
+			return false, errors.WithStack(err)
+		}
+		return true, nil
+	case <-time.After(t.cfg.Timeout):
+		go func() {
+			<-done
+			os.RemoveAll(tmpPath)
+		}()
+		err := t.timeoutErr()
+		t.record(err)
+		return false, err
+	}
+}
+
+func (t *breakerTier) Store(key, srcPath string) error {
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Tier.Store(key, srcPath)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(t.cfg.Timeout):
+		err = t.timeoutErr()
+	}
+	t.record(err)
+	return err
+}
+
+func (t *breakerTier) timeoutErr() error {
+	return ErrTierTimeout{
+		error:   errors.New("request timed out"),
+		Tier:    t.Name(),
+		Timeout: t.cfg.Timeout,
+	}
+}
+
+func (t *breakerTier) checkOpen() error {
+	state := t.loadState()
+	if time.Now().Before(state.OpenUntil) {
+		if !t.cfg.ReadOnly {
+			updateStats(t.basePath, func(s *Stats) { s.RemoteSkips++ })
+		}
+		return ErrCircuitOpen{
+			error: errors.New("circuit open"),
+			Tier:  t.Name(),
+			Until: state.OpenUntil,
+		}
+	}
+	return nil
+}
+
+func (t *breakerTier) record(err error) {
+	if t.cfg.ReadOnly || (err == nil && t.loadState().Failures == 0) {
+		// nothing to reset
+		return
+	}
+
+	if mErr := os.MkdirAll(filepath.Dir(t.statePath), os.ModePerm); mErr != nil {
+		t.log.Warn("failed to save circuit breaker state %s - %+v", t.statePath, mErr)
+		return
+	}
+	lock, lErr := acquireLock(t.statePath+".lock", breakerLockTimeout)
+	if lErr != nil {
+		t.log.Warn("failed to lock circuit breaker state %s - %+v", t.statePath, lErr)
+		return
+	}
+	defer lock.Release()
+
+	state := t.loadState()
+	if err == nil {
+		if state.Failures == 0 {
+			return
+		}
+		state = breakerState{}
+	} else {
+		_, timedOut := err.(ErrTierTimeout)
+		updateStats(t.basePath, func(s *Stats) {
+			s.RemoteErrors++
+			if timedOut {
+				s.RemoteTimeouts++
+			}
+		})
+
+		state.Failures++
+		if state.Failures >= t.cfg.MaxFailures {
+			state.OpenUntil = time.Now().Add(t.cfg.Cooldown).UTC()
+			t.log.Warn("%d consecutive failures. skipping %s until %v",
+				state.Failures, t.Name(), state.OpenUntil)
+		}
+	}
+
+	if err := t.saveState(state); err != nil {
+		t.log.Warn("failed to save circuit breaker state %s - %+v", t.statePath, err)
+	}
+}
+
+func (t *breakerTier) loadState() breakerState {
+	state := breakerState{}
+	file, err := os.Open(t.statePath)
+	if err != nil {
+		return state
+	}
+	defer file.Close()
+
+	NewDecoder(file).Decode(&state)
+	return state
+}
+
+// saveState writes state. The caller holds the lock of statePath.
+func (t *breakerTier) saveState(state breakerState) error {
+	dir := filepath.Dir(t.statePath)
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = NewEncoder(tmp).Encode(state)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), t.statePath))
+}
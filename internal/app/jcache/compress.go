@@ -0,0 +1,212 @@
+package jcache
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+
+	DefaultCompressionLevel = 6
+)
+
+// StorageInfo describes how the output trees of an entry are stored.
+// Entries without a storage-info.json predate compression and are raw
+// trees. HashAlgo computed the entry's key and the digests of its
+// manifest; it is "" for entries predating it, which used DigestSha256.
+type StorageInfo struct {
+	Layout      string
+	Compression string
+	HashAlgo    string
+	RawBytes    int64
+	StoredBytes int64
+}
+
+func ParseCompression(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip:
+		return CompressionGzip, nil
+	}
+	return CompressionNone, fmt.Errorf("unsupported compression: %s", s)
+}
+
+// ParseCompressionLevel accepts the gzip levels from 1 (fastest) to 9
+// (smallest).
+func ParseCompressionLevel(s string) (int, error) {
+	level, err := strconv.Atoi(strings.TrimSpace(s))
+	if err == nil {
+		err = checkCompressionLevel(level)
+	}
+	if err != nil {
+		return DefaultCompressionLevel, fmt.Errorf("unsupported compression level: %s", s)
+	}
+	return level, nil
+}
+
+func checkCompressionLevel(level int) error {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return fmt.Errorf("unsupported compression level: %d", level)
+	}
+	return nil
+}
+
+// storeAll prepares the output trees below entryPath for storage,
+// compressing every file in place unless compression is CompressionNone.
+// It returns the manifest of all stored files, digested with algo.
+func storeAll(entryPath string, trees []string, compression string, level int, algo string) (manifest []ManifestEntry, rawBytes, storedBytes int64, err error) {
+	err = walkTrees(entryPath, trees, func(path, rel string, stat os.FileInfo) error {
+		raw, stored, digest, err := storeFile(path, compression, level, algo)
+		if err != nil {
+			return err
+		}
+
+		manifest = append(manifest, newManifestEntry(rel, digest, raw, stat))
+		rawBytes += raw
+		storedBytes += stored
+		return nil
+	})
+	return
+}
+
+// walkTrees calls fn for every regular file in the trees below entryPath
+// with its absolute and its slash separated entry-relative path.
+func walkTrees(entryPath string, trees []string, fn func(path, rel string, stat os.FileInfo) error) error {
+	for _, tree := range trees {
+		root := filepath.Join(entryPath, tree)
+		if DoesNotExist(root) {
+			continue
+		}
+
+		err := godirwalk.Walk(root, &godirwalk.Options{
+			Unsorted: true,
+			Callback: func(path string, de *godirwalk.Dirent) error {
+				if !de.IsRegular() {
+					return nil
+				}
+
+				rel, err := filepath.Rel(entryPath, path)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				stat, err := os.Stat(path)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				return fn(path, filepath.ToSlash(rel), stat)
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeFile compresses the file at path in place and returns the algo
+// digest of its raw content.
+func storeFile(path, compression string, level int, algo string) (raw, stored int64, digest string, err error) {
+	if compression == CompressionNone {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return 0, 0, "", errors.WithStack(err)
+		}
+		digest, err = HashFile(path, algo)
+		if err != nil {
+			return 0, 0, "", errors.WithStack(err)
+		}
+		return stat.Size(), stat.Size(), digest, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".gz-")
+	if err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw, err := gzip.NewWriterLevel(tmp, level)
+	if err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+	hash, err := newHash(algo)
+	if err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+	raw, err = io.Copy(zw, io.TeeReader(src, hash))
+	if err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+	if err = zw.Close(); err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+	stored, err = tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, 0, "", errors.WithStack(err)
+	}
+
+	digest = hex.EncodeToString(hash.Sum(nil))
+	return raw, stored, digest, errors.WithStack(os.Rename(tmp.Name(), path))
+}
+
+// restoreFunc returns the copyFunc restoring files stored with
+// compression. Raw files are restored by r.
+func restoreFunc(compression string, r *restorer) copyFunc {
+	if compression == CompressionGzip {
+		return r.wrap(gunzipFile)
+	}
+	return r.wrap(r.copy)
+}
+
+func gunzipFile(from, to string) (int64, error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return 0, corruptEntry(from, "%v", err)
+	}
+	defer zr.Close()
+
+	dst, err := createFile(to)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, zr)
+	return n, corruptUnlessPathError(from, err)
+}
+
+// corruptUnlessPathError turns errors decoding a stored file into
+// ErrCorruptEntry. Errors reading or writing files are left alone.
+func corruptUnlessPathError(from string, err error) error {
+	if _, ok := err.(*os.PathError); err == nil || ok {
+		return err
+	}
+	return corruptEntry(from, "%v", err)
+}
@@ -0,0 +1,437 @@
+package jcache
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConfFileName        = "jcache.conf"
+	ProjectConfFileName = ".jcache.conf"
+	confEnvPrefix       = "JCACHE_"
+)
+
+type (
+	confDef struct {
+		key    string
+		def    func() string
+		isPath bool
+		// nonEmpty keys treat empty values, e.g. JCACHE_PATH=, as unset.
+		nonEmpty bool
+		// check parses a value the way the key's reader does; nil for
+		// plain strings.
+		check func(string) error
+	}
+
+	// ConfValue is a configuration value together with where it came from.
+	ConfValue struct {
+		Key    string
+		Value  string
+		Origin string
+	}
+
+	// Conf is the merged configuration. Later layers override earlier ones:
+	// defaults, system file, user file, project file, environment.
+	Conf struct {
+		values   map[string]ConfValue
+		errs     []error
+		rejected map[string]bool
+	}
+
+	ErrUnknownConfKey struct {
+		error
+		Key string
+	}
+
+	ErrInvalidConfValue struct {
+		error
+		ConfValue
+	}
+)
+
+func constant(s string) func() string {
+	return func() string { return s }
+}
+
+// confDefs lists all known keys in the order they are printed. Every key
+// can be overridden by the environment variable JCACHE_<KEY>.
+var confDefs = []confDef{
+	{key: "path", def: DefaultCachePath, isPath: true, nonEmpty: true},
+	{key: "verbose", def: constant("false"), check: isBool},
+	{key: "log_level", def: constant("info"), check: isLogLevel},
+	{key: "log_format", def: constant(LogFormatText), check: isOneOf(ParseLogFormat)},
+	{key: "log_max_size", def: constant(strconv.Itoa(DefaultLogMaxSize >> 20)), check: isInt},
+	{key: "log_max_files", def: constant(strconv.Itoa(DefaultLogMaxFiles)), check: isInt},
+	{key: "report", def: constant(""), isPath: true},
+	{key: "tag", def: constant("")},
+	{key: "disable", def: constant("false"), check: isBool},
+	{key: "readonly", def: constant("false"), check: isBool},
+	{key: "recache", def: constant("false"), check: isBool},
+	{key: "secondary_dir", def: constant(""), isPath: true},
+	{key: "secondary_mode", def: constant(TierReadOnly.String()), check: isTierMode},
+	{key: "secondary_umask", def: constant("022"), check: isFileMode},
+	{key: "secondary_group", def: constant("")},
+	{key: "async_uploads", def: constant("true"), check: isBool},
+	{key: "upload_queue_size", def: constant(strconv.Itoa(DefaultUploadQueueSize)), check: isInt},
+	{key: "remote_timeout", def: constant(DefaultRemoteTimeout.String()), check: isDuration},
+	{key: "remote_max_failures", def: constant(strconv.Itoa(DefaultRemoteMaxFailures)), check: isInt},
+	{key: "remote_cooldown", def: constant(DefaultRemoteCooldown.String()), check: isDuration},
+	{key: "storage_layout", def: constant(LayoutTree), check: isOneOf(ParseLayout)},
+	{key: "compression", def: constant(CompressionNone), check: isOneOf(ParseCompression)},
+	{key: "compression_level", def: constant(strconv.Itoa(DefaultCompressionLevel)), check: isCompressionLevel},
+	{key: "restore_strategy", def: constant(RestoreAuto), check: isOneOf(ParseRestoreStrategy)},
+	{key: "restore_skip_identical", def: constant("true"), check: isBool},
+	{key: "restore_remove_stale", def: constant("false"), check: isBool},
+	{key: "restore_mtime", def: constant(MTimeNow), check: isOneOf(ParseMTimePolicy)},
+	{key: "restore_fsync", def: constant(FsyncNone), check: isOneOf(ParseFsyncPolicy)},
+	{key: "restore_verify", def: constant("true"), check: isBool},
+	{key: "namespace", def: constant("")},
+	{key: "hash_algorithm", def: constant(DefaultHashAlgo), check: isOneOf(ParseHashAlgo)},
+	{key: "git_fingerprints", def: constant("false"), check: isBool},
+	{key: "io_concurrency", def: func() string { return strconv.Itoa(DefaultIOConcurrency()) }, check: isInt},
+}
+
+// The checks parse like the typed getters and the Parse functions the
+// respective values are read with.
+
+func isBool(s string) error {
+	_, err := strconv.ParseBool(s)
+	return err
+}
+
+func isInt(s string) error {
+	_, err := strconv.Atoi(s)
+	return err
+}
+
+func isDuration(s string) error {
+	_, err := time.ParseDuration(s)
+	return err
+}
+
+func isFileMode(s string) error {
+	_, err := strconv.ParseUint(s, 8, 32)
+	return err
+}
+
+func isLogLevel(s string) error {
+	_, err := ParseLogLevel(s)
+	return err
+}
+
+func isTierMode(s string) error {
+	_, err := ParseTierMode(s)
+	return err
+}
+
+func isCompressionLevel(s string) error {
+	_, err := ParseCompressionLevel(s)
+	return err
+}
+
+// isOneOf checks values with the parser of an enumeration.
+func isOneOf(parse func(string) (string, error)) func(string) error {
+	return func(s string) error {
+		_, err := parse(s)
+		return err
+	}
+}
+
+func findConfDef(key string) (confDef, error) {
+	for _, d := range confDefs {
+		if d.key == key {
+			return d, nil
+		}
+	}
+	return confDef{}, ErrUnknownConfKey{
+		error: errors.New("unknown configuration key"),
+		Key:   key,
+	}
+}
+
+// DefaultCachePath is $XDG_CACHE_HOME/jcache.
+func DefaultCachePath() string {
+	return filepath.Join(xdgDir("XDG_CACHE_HOME", os.UserCacheDir, ".cache"), "jcache")
+}
+
+func SystemConfPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "jcache", ConfFileName)
+	}
+	return filepath.Join("/etc", "jcache", ConfFileName)
+}
+
+// UserConfPath is $XDG_CONFIG_HOME/jcache/jcache.conf.
+func UserConfPath() string {
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", os.UserConfigDir, ".config"), "jcache", ConfFileName)
+}
+
+// FindProjectConf walks up from dir and returns the first project
+// configuration file found, or "" if there is none.
+func FindProjectConf(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, ProjectConfFileName)
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			return path
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func xdgDir(env string, platformDir func() (string, error), homeRel string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	if dir, err := platformDir(); err == nil {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, homeRel)
+}
+
+// LoadConf merges all configuration layers for an invocation in cwd.
+// Malformed lines and unknown keys are skipped, files that fail to load as
+// a whole; Errors reports both.
+func LoadConf(cwd string) *Conf {
+	c := &Conf{values: make(map[string]ConfValue), rejected: make(map[string]bool)}
+	for _, d := range confDefs {
+		c.values[d.key] = ConfValue{Key: d.key, Value: d.def(), Origin: "default"}
+	}
+
+	files := []struct{ origin, path string }{
+		{"system", SystemConfPath()},
+		{"user", UserConfPath()},
+		{"project", FindProjectConf(cwd)},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if err := c.loadFile(f.origin, f.path); err != nil {
+			c.errs = append(c.errs, err)
+		}
+	}
+
+	for _, d := range confDefs {
+		env := confEnvPrefix + strings.ToUpper(d.key)
+		if value, ok := os.LookupEnv(env); ok && (value != "" || !d.nonEmpty) {
+			c.values[d.key] = ConfValue{Key: d.key, Value: value, Origin: "environment " + env}
+		}
+	}
+
+	return c
+}
+
+func (c *Conf) loadFile(origin, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		key, value, ok := parseConfLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if key == "" {
+			c.errs = append(c.errs, fmt.Errorf("%s:%d: missing '='", path, lineNo))
+			continue
+		}
+
+		d, err := findConfDef(key)
+		if err != nil {
+			c.errs = append(c.errs, errors.Wrapf(err, "%s:%d: %s", path, lineNo, key))
+			continue
+		}
+		if value == "" && d.nonEmpty {
+			continue
+		}
+		if d.isPath && value != "" && !filepath.IsAbs(value) {
+			// relative paths are relative to the file they appear in
+			value = filepath.Join(filepath.Dir(path), value)
+		}
+		c.values[key] = ConfValue{Key: key, Value: value, Origin: origin + " file " + path}
+	}
+	return errors.WithStack(scanner.Err())
+}
+
+// parseConfLine splits a "key = value" line. ok is false for blank lines
+// and comments; key is empty for malformed lines.
+func parseConfLine(line string) (key, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", "", false
+	}
+	idx := strings.IndexByte(line, '=')
+	if idx < 0 {
+		return "", "", true
+	}
+	return strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:]), true
+}
+
+// Values returns all configuration values in a stable order.
+func (c *Conf) Values() []ConfValue {
+	values := make([]ConfValue, len(confDefs))
+	for i, d := range confDefs {
+		values[i] = c.values[d.key]
+	}
+	return values
+}
+
+func (c *Conf) Lookup(key string) (ConfValue, error) {
+	if _, err := findConfDef(key); err != nil {
+		return ConfValue{}, err
+	}
+	return c.values[key], nil
+}
+
+func (c *Conf) String(key string) string {
+	return c.values[key].Value
+}
+
+// Reject reports the value of key as invalid by err, unless err is nil.
+// The caller falls back to the default.
+func (c *Conf) Reject(key string, err error) {
+	if err == nil || c.rejected[key] {
+		return
+	}
+	c.rejected[key] = true
+
+	v := c.values[key]
+	c.errs = append(c.errs, ErrInvalidConfValue{
+		error:     errors.Errorf("invalid %s '%s' (%s): %v", key, v.Value, v.Origin, err),
+		ConfValue: v,
+	})
+}
+
+// Errors returns the files that failed to load and the rejected values.
+func (c *Conf) Errors() []error {
+	return c.errs
+}
+
+// The typed getters fall back to the default if a value does not parse,
+// rejecting it.
+
+func (c *Conf) Bool(key string) bool {
+	b, err := strconv.ParseBool(c.String(key))
+	if err != nil {
+		c.Reject(key, err)
+		d, _ := findConfDef(key)
+		b, _ = strconv.ParseBool(d.def())
+	}
+	return b
+}
+
+func (c *Conf) Int(key string) int {
+	i, err := strconv.Atoi(c.String(key))
+	if err != nil {
+		c.Reject(key, err)
+		d, _ := findConfDef(key)
+		i, _ = strconv.Atoi(d.def())
+	}
+	return i
+}
+
+func (c *Conf) Duration(key string) time.Duration {
+	t, err := time.ParseDuration(c.String(key))
+	if err != nil {
+		c.Reject(key, err)
+		d, _ := findConfDef(key)
+		t, _ = time.ParseDuration(d.def())
+	}
+	return t
+}
+
+func (c *Conf) FileMode(key string) os.FileMode {
+	u, err := strconv.ParseUint(c.String(key), 8, 32)
+	if err != nil {
+		c.Reject(key, err)
+		d, _ := findConfDef(key)
+		u, _ = strconv.ParseUint(d.def(), 8, 32)
+	}
+	return os.FileMode(u) & os.ModePerm
+}
+
+// SetConf sets key to value in the configuration file at path, keeping
+// all other lines of the file and its permissions untouched. Values that
+// would be rejected on load are refused with ErrInvalidConfValue.
+func SetConf(path, key, value string) error {
+	d, err := findConfDef(key)
+	if err != nil {
+		return err
+	}
+	if d.check != nil {
+		if err = d.check(value); err != nil {
+			return ErrInvalidConfValue{
+				error:     errors.Errorf("invalid %s '%s': %v", key, value, err),
+				ConfValue: ConfValue{Key: key, Value: value},
+			}
+		}
+	}
+
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(path); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	found := false
+	for i, line := range lines {
+		if k, _, ok := parseConfLine(line); ok && k == key {
+			lines[i] = key + " = " + value
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, key+" = "+value)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+ConfFileName+"-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tmp.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		// TempFile creates files readable by the owner only
+		err = tmp.Chmod(mode)
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
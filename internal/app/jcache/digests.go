@@ -0,0 +1,212 @@
+package jcache
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	digestCacheFileName    = "digests.json"
+	digestCacheLockTimeout = 2 * time.Second
+	// the least recently used digests are dropped beyond this many
+	digestCacheMaxEntries = 1 << 16
+)
+
+type (
+	// fileStamp identifies the state of a file without reading it. A file
+	// whose stamp did not change is assumed to keep its content.
+	fileStamp struct {
+		Dev        uint64
+		Ino        uint64
+		Size       int64
+		ModTime    int64
+		ChangeTime int64
+	}
+
+	digestCacheEntry struct {
+		Stamp fileStamp
+		// Digest is computed by the algorithm the entry's key starts with.
+		Digest string
+		// Used is the unix time the digest was last looked up.
+		Used int64
+	}
+
+	// digestCache remembers the digests of files by algorithm, absolute
+	// path and stamp. It is shared by all invocations using the same basePath,
+	// so that files touched but not changed, e.g. by a git checkout, cost
+	// a stat call instead of a full read.
+	digestCache struct {
+		path    string
+		mu      sync.Mutex
+		entries map[string]digestCacheEntry
+		// dirty holds the entries looked up or added since loading.
+		dirty map[string]digestCacheEntry
+	}
+)
+
+func newFileStamp(fi os.FileInfo) fileStamp {
+	s := fileStamp{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	sysStamp(&s, fi)
+	return s
+}
+
+// loadDigestCache starts over with an empty cache if the file is missing
+// or unreadable; the cache only saves work.
+func loadDigestCache(basePath string) *digestCache {
+	c := &digestCache{
+		path:  filepath.Join(basePath, digestCacheFileName),
+		dirty: make(map[string]digestCacheEntry),
+	}
+	c.entries, _ = readDigestCache(c.path)
+	if c.entries == nil {
+		c.entries = make(map[string]digestCacheEntry)
+	}
+	return c
+}
+
+func readDigestCache(path string) (entries map[string]digestCacheEntry, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = NewDecoder(file).Decode(&entries)
+	return
+}
+
+// digest returns the algo digest of the file at path, hashing it only if
+// its stamp is unknown.
+func (c *digestCache) digest(path, algo string) (string, os.FileInfo, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	key := algo + ":" + abs
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	stamp := newFileStamp(stat)
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || e.Stamp != stamp {
+		e.Stamp = stamp
+		if e.Digest, err = HashFile(path, algo); err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+		after, err := os.Stat(path)
+		if err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+		if newFileStamp(after) != stamp {
+			// the file changed while being hashed, the digest may match
+			// neither stamp
+			return e.Digest, stat, nil
+		}
+	}
+	now := time.Now()
+	if isRacy(stat.ModTime(), now) {
+		// the file may change again without its stamp changing
+		return e.Digest, stat, nil
+	}
+	e.Used = now.Unix()
+
+	c.mu.Lock()
+	c.entries[key] = e
+	c.dirty[key] = e
+	c.mu.Unlock()
+	return e.Digest, stat, nil
+}
+
+// digestAll digests each of paths with the respective one of algos, with
+// up to workers files at once. The results are in the order of paths.
+func (c *digestCache) digestAll(paths, algos []string, workers int) ([]string, []os.FileInfo, []error) {
+	digests := make([]string, len(paths))
+	stats := make([]os.FileInfo, len(paths))
+	errs := make([]error, len(paths))
+
+	if workers < 1 {
+		workers = DefaultIOConcurrency()
+	}
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, path string) {
+			defer wg.Done()
+			digests[i], stats[i], errs[i] = c.digest(path, algos[i])
+			<-sem
+		}(i, path)
+	}
+	wg.Wait()
+
+	return digests, stats, errs
+}
+
+// save merges the entries looked up since loading into the file, which
+// may have been updated by other invocations in the meantime.
+func (c *digestCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.dirty) == 0 {
+		return nil
+	}
+
+	lock, err := acquireLock(c.path+".lock", digestCacheLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	entries, err := readDigestCache(c.path)
+	if err != nil {
+		entries = make(map[string]digestCacheEntry)
+	}
+	for key, e := range c.dirty {
+		entries[key] = e
+	}
+	evictDigests(entries, digestCacheMaxEntries)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".digests-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = NewEncoder(tmp).Encode(entries)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(tmp.Name(), c.path); err != nil {
+		return errors.WithStack(err)
+	}
+	c.dirty = make(map[string]digestCacheEntry)
+	return nil
+}
+
+// evictDigests drops the least recently used entries beyond max.
+func evictDigests(entries map[string]digestCacheEntry, max int) {
+	if len(entries) <= max {
+		return
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].Used < entries[keys[j]].Used
+	})
+	for _, key := range keys[:len(keys)-max] {
+		delete(entries, key)
+	}
+}
@@ -0,0 +1,311 @@
+package jcache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	entryInfoFileName     = "entry-info.json"
+	entryUsageFileName    = "usage.json"
+	entryUsageLockTimeout = 2 * time.Second
+)
+
+type (
+	// EntryInfo describes where an entry comes from. Namespace is the
+	// label of the cache user that stored it, e.g. a project, and selects
+	// entries to export. Host, User, Version and Args are empty for
+	// entries predating them.
+	EntryInfo struct {
+		Namespace string
+		CreatedAt time.Time
+		Host      string
+		User      string
+		// Version is the version of jcache that stored the entry.
+		Version string
+		// Args are the arguments jcache was invoked with, starting with
+		// the compiler.
+		Args []string
+	}
+
+	// EntryUsage counts the hits an entry served. Updates are best
+	// effort; concurrent hits may go uncounted.
+	EntryUsage struct {
+		Hits    int64
+		LastHit time.Time
+	}
+
+	// EntrySummary describes an entry in a single line's worth.
+	EntrySummary struct {
+		Key         string
+		StoredBytes int64
+		Info        EntryInfo
+		Usage       EntryUsage
+		// SourceDir is the deepest directory holding all sources.
+		SourceDir string
+	}
+
+	// EntryDetails describes an entry in full.
+	EntryDetails struct {
+		EntrySummary
+		Storage StorageInfo
+		Sources []FileInfo
+		Exec    ExecInfo
+		// Outputs are the slash separated paths of the output files,
+		// starting with their tree, e.g. classes/jcache/Foo.class.
+		Outputs []string
+	}
+)
+
+func entryInfoPath(entryPath string) string {
+	return filepath.Join(entryPath, entryInfoFileName)
+}
+
+func entryUsagePath(entryPath string) string {
+	return filepath.Join(entryPath, entryUsageFileName)
+}
+
+// newEntryInfo describes an entry stored by this process right now.
+func newEntryInfo(namespace, version string, args []string) *EntryInfo {
+	info := &EntryInfo{
+		Namespace: namespace,
+		CreatedAt: time.Now().UTC(),
+		Version:   version,
+		Args:      args,
+	}
+	info.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		info.User = u.Username
+	} else {
+		info.User = os.Getenv("USER")
+	}
+	return info
+}
+
+// loadEntryInfo returns the info of the entry at entryPath. For entries
+// predating entry-info.json, it is made up from what the entry does
+// record: the time compiler-info.json was written.
+func loadEntryInfo(entryPath string) (*EntryInfo, error) {
+	path := entryInfoPath(entryPath)
+	if !DoesNotExist(path) {
+		return UnmarshalEntryInfo(path)
+	}
+
+	stat, err := os.Stat(filepath.Join(entryPath, "compiler-info.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &EntryInfo{CreatedAt: stat.ModTime().UTC()}, nil
+}
+
+func loadEntryUsage(entryPath string) (*EntryUsage, error) {
+	path := entryUsagePath(entryPath)
+	if DoesNotExist(path) {
+		return &EntryUsage{}, nil
+	}
+	return UnmarshalEntryUsage(path)
+}
+
+// recordHit counts a hit of the entry at entryPath.
+func recordHit(entryPath string) error {
+	path := entryUsagePath(entryPath)
+	// dot files are left out of exports
+	lock, err := acquireLock(filepath.Join(entryPath, ".usage.lock"), entryUsageLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	usage, err := loadEntryUsage(entryPath)
+	if err != nil {
+		// start over rather than being stuck with a broken file
+		usage = &EntryUsage{}
+	}
+	usage.Hits++
+	usage.LastHit = time.Now().UTC()
+
+	tmp, err := ioutil.TempFile(entryPath, ".usage-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err = MarshalEntryUsage(usage, tmp.Name()); err != nil {
+		return err
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
+
+// commonDir returns the deepest directory holding all of paths.
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	dir := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for dir != "." && dir != string(filepath.Separator) &&
+			!strings.HasPrefix(filepath.Dir(path)+string(filepath.Separator), dir+string(filepath.Separator)) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return dir
+}
+
+func summarizeEntry(entryPath string) (*EntrySummary, []FileInfo, error) {
+	info, err := loadEntryInfo(entryPath)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	usage, err := loadEntryUsage(entryPath)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	sources, err := UnmarshalFileInfoSlice(filepath.Join(entryPath, "source-info.json"))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	s := &EntrySummary{
+		Key:   filepath.Base(entryPath),
+		Info:  *info,
+		Usage: *usage,
+	}
+	if si, err := UnmarshalStorageInfo(filepath.Join(entryPath, "storage-info.json")); err == nil {
+		s.StoredBytes = si.StoredBytes
+	}
+	paths := make([]string, len(sources))
+	for i, src := range sources {
+		paths[i] = src.Path
+	}
+	s.SourceDir = commonDir(paths)
+	return s, sources, nil
+}
+
+// completeEntries returns the keys of the complete entries below basePath.
+// Incomplete entries may be stored right now and are left out.
+func completeEntries(basePath string) ([]string, error) {
+	infos, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var keys []string
+	for _, info := range infos {
+		if !info.IsDir() || !isEntryKey(info.Name()) {
+			continue
+		}
+		entryPath := filepath.Join(basePath, info.Name())
+		if anyNotExists(filepath.Join(entryPath, "source-info.json"),
+			filepath.Join(entryPath, "compiler-info.json")) {
+			continue
+		}
+		keys = append(keys, info.Name())
+	}
+	return keys, nil
+}
+
+// ListEntries summarizes the complete entries below basePath, newest
+// first. Entries whose metadata does not parse are left out.
+func ListEntries(basePath string) ([]EntrySummary, error) {
+	keys, err := completeEntries(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []EntrySummary
+	for _, key := range keys {
+		s, _, err := summarizeEntry(filepath.Join(basePath, key))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, *s)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Info.CreatedAt.After(entries[j].Info.CreatedAt)
+	})
+	return entries, nil
+}
+
+// ShowEntry describes the complete entry whose key is or starts with key.
+func ShowEntry(basePath, key string) (*EntryDetails, error) {
+	keys, err := completeEntries(basePath)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, k := range keys {
+		if k == key {
+			matches = []string{k}
+			break
+		}
+		if strings.HasPrefix(k, key) {
+			matches = append(matches, k)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no entry %s", key)
+	case 1:
+	default:
+		return nil, fmt.Errorf("ambiguous key %s matches %d entries", key, len(matches))
+	}
+
+	entryPath := filepath.Join(basePath, matches[0])
+	s, sources, err := summarizeEntry(entryPath)
+	if err != nil {
+		return nil, err
+	}
+	d := &EntryDetails{
+		EntrySummary: *s,
+		Storage:      StorageInfo{Layout: LayoutTree, Compression: CompressionNone, HashAlgo: DigestSha256},
+		Sources:      sources,
+	}
+	if path := filepath.Join(entryPath, "storage-info.json"); !DoesNotExist(path) {
+		si, err := UnmarshalStorageInfo(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		d.Storage = *si
+		if d.Storage.HashAlgo == "" {
+			d.Storage.HashAlgo = DigestSha256
+		}
+	}
+	ci, err := UnmarshalExecInfo(filepath.Join(entryPath, "compiler-info.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d.Exec = *ci
+
+	if path := filepath.Join(entryPath, "manifest.json"); !DoesNotExist(path) {
+		manifest, err := loadManifest(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, me := range manifest {
+			d.Outputs = append(d.Outputs, me.Path)
+		}
+	} else {
+		err = walkTrees(entryPath, []string{"classes", "include", "generated"},
+			func(_, rel string, _ os.FileInfo) error {
+				d.Outputs = append(d.Outputs, rel)
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(d.Outputs)
+	return d, nil
+}
@@ -9,7 +9,15 @@ import (
 	"path/filepath"
 )
 
+type copyFunc func(from, to string) (int64, error)
+
 func copyAll(srcPath, dstPath string) (nFiles int, nBytes int64, err error) {
+	return walkCopy(srcPath, dstPath, copyFile)
+}
+
+// walkCopy mirrors the tree at srcPath to dstPath, copying every regular
+// file with cp.
+func walkCopy(srcPath, dstPath string, cp copyFunc) (nFiles int, nBytes int64, err error) {
 	err = godirwalk.Walk(srcPath, &godirwalk.Options{
 		FollowSymbolicLinks: true,
 		Unsorted:            true,
@@ -43,7 +51,7 @@ func copyAll(srcPath, dstPath string) (nFiles int, nBytes int64, err error) {
 				return errors.WithStack(err)
 			}
 
-			w, err := copyFile(src, dst)
+			w, err := cp(src, dst)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -58,6 +66,31 @@ func copyAll(srcPath, dstPath string) (nFiles int, nBytes int64, err error) {
 	return
 }
 
+// createFile creates the file at path. An existing file is unlinked rather
+// than truncated; it may be a hard link to a cached file.
+func createFile(path string) (*os.File, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// linkFile hard links to to from, copying if linking fails, e.g. on
+// file systems without hard links.
+func linkFile(from, to string) (int64, error) {
+	if err := os.Remove(to); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := os.Link(from, to); err != nil {
+		return copyFile(from, to)
+	}
+	stat, err := os.Stat(to)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
 func copyFile(from, to string) (int64, error) {
 	src, err := os.Open(from)
 	if err != nil {
@@ -65,7 +98,7 @@ func copyFile(from, to string) (int64, error) {
 	}
 	defer src.Close()
 
-	dst, err := os.Create(to)
+	dst, err := createFile(to)
 	if err != nil {
 		return 0, err
 	}
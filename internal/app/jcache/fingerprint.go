@@ -0,0 +1,104 @@
+package jcache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+type (
+	// fingerprinter digests source files. With git enabled, files inside
+	// git working trees are digested as git blobs, so that the digests of
+	// clean files can be taken from the index instead of being read.
+	fingerprinter struct {
+		digests *digestCache
+		workers int
+		// algo digests files outside git working trees.
+		algo string
+		git  *gitIndex
+	}
+)
+
+func newFingerprinter(digests *digestCache, workers int, algo string, git bool) *fingerprinter {
+	f := &fingerprinter{digests: digests, workers: workers, algo: algo}
+	if git {
+		f.git = newGitIndex()
+	}
+	return f
+}
+
+func gitBlobFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "blob %d\x00", stat.Size())
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// algos picks the algorithm new records of paths are digested with.
+func (f *fingerprinter) algos(paths []string) []string {
+	algos := make([]string, len(paths))
+	for i, path := range paths {
+		algos[i] = f.algo
+		if f.git != nil && f.git.toplevel(path) != "" {
+			algos[i] = DigestGitBlob
+		}
+	}
+	return algos
+}
+
+// fingerprint digests each of paths with the respective one of algos.
+// The results are in the order of paths.
+func (f *fingerprinter) fingerprint(paths, algos []string) ([]string, []os.FileInfo, []error) {
+	digests := make([]string, len(paths))
+	stats := make([]os.FileInfo, len(paths))
+	errs := make([]error, len(paths))
+
+	var gitPaths []string
+	if f.git != nil {
+		for i, path := range paths {
+			if algos[i] == DigestGitBlob {
+				gitPaths = append(gitPaths, path)
+			}
+		}
+	}
+	clean := make(map[string]string)
+	if len(gitPaths) > 0 {
+		clean = f.git.cleanBlobs(gitPaths)
+	}
+
+	var hashIdx []int
+	var hashPaths, hashAlgos []string
+	for i, path := range paths {
+		if blob, ok := clean[path]; ok && algos[i] == DigestGitBlob {
+			digests[i] = blob
+			stat, err := os.Stat(path)
+			stats[i], errs[i] = stat, errors.WithStack(err)
+			continue
+		}
+		hashIdx = append(hashIdx, i)
+		hashPaths = append(hashPaths, path)
+		hashAlgos = append(hashAlgos, algos[i])
+	}
+
+	d, s, e := f.digests.digestAll(hashPaths, hashAlgos, f.workers)
+	for k, i := range hashIdx {
+		digests[i], stats[i], errs[i] = d[k], s[k], e[k]
+	}
+	return digests, stats, errs
+}
@@ -0,0 +1,78 @@
+package jcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// FormatVersion is the version of the layout of the cache directory
+	// and the metadata files in it. Fields added to metadata files leave
+	// it alone, as readers ignore fields they do not know. Changes older
+	// readers would misread bump it and come with a migration.
+	//
+	//	0: sources are recorded with Sha256 and DigestAlgo
+	//	1: sources are recorded with a Digest, format.json at basePath
+	//	2: every entry records its version in its own format.json
+	FormatVersion = 2
+
+	formatFileName = "format.json"
+)
+
+type (
+	// CacheFormat describes a cache directory as a whole. Version is the
+	// newest format any jcache stored entries in. HashAlgo keys and
+	// digests the entries stored from now on; older entries record their
+	// own.
+	CacheFormat struct {
+		Version  int
+		HashAlgo string
+	}
+
+	// EntryFormat describes the metadata files of a single entry.
+	EntryFormat struct {
+		Version int
+	}
+)
+
+func formatPath(basePath string) string {
+	return filepath.Join(basePath, formatFileName)
+}
+
+// LoadCacheFormat returns nil if the cache predates format.json.
+func LoadCacheFormat(basePath string) (*CacheFormat, error) {
+	path := formatPath(basePath)
+	if DoesNotExist(path) {
+		return nil, nil
+	}
+	return UnmarshalCacheFormat(path)
+}
+
+// recordCacheFormat updates format.json to the current version and
+// hashAlgo, unless it is up to date already. It never lowers the version
+// a newer jcache recorded.
+func recordCacheFormat(basePath, hashAlgo string) error {
+	want := &CacheFormat{Version: FormatVersion, HashAlgo: hashAlgo}
+	cf, err := LoadCacheFormat(basePath)
+	if err == nil && cf != nil {
+		if cf.Version > want.Version {
+			want.Version = cf.Version
+		}
+		if *cf == *want {
+			return nil
+		}
+	}
+
+	tmp, err := ioutil.TempFile(basePath, ".format-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err = MarshalCacheFormat(want, tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), formatPath(basePath))
+}
@@ -0,0 +1,161 @@
+package jcache
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// gitPathspecBatch bounds the number of paths passed to a single git
+// command, keeping its command line well below any OS limit.
+const gitPathspecBatch = 512
+
+// gitIndex looks up files in the index of the git working trees they are
+// in. Failing git commands only mean that files get hashed by jcache.
+type gitIndex struct {
+	mu sync.Mutex
+	// toplevels caches the working tree root of directories. Directories
+	// outside any working tree map to "".
+	toplevels map[string]string
+}
+
+func newGitIndex() *gitIndex {
+	return &gitIndex{toplevels: make(map[string]string)}
+}
+
+// resolve returns the absolute path of path with all symlinks evaluated,
+// as git reports paths relative to the real working tree root.
+func resolve(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// toplevel returns the root of the working tree holding path or "".
+func (g *gitIndex) toplevel(path string) string {
+	real, err := resolve(path)
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Dir(real)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	top, ok := g.toplevels[dir]
+	if !ok {
+		out, err := exec.Command("git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+		if err == nil {
+			top = filepath.FromSlash(strings.TrimSpace(string(out)))
+		}
+		g.toplevels[dir] = top
+	}
+	return top
+}
+
+// cleanBlobs returns the blob ids the index holds for those of paths that
+// are tracked and whose working tree files match the index.
+func (g *gitIndex) cleanBlobs(paths []string) map[string]string {
+	// paths relative to their working tree root, by root
+	byTop := make(map[string]map[string]string)
+	for _, path := range paths {
+		top := g.toplevel(path)
+		if top == "" {
+			continue
+		}
+		real, err := resolve(path)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(top, real)
+		if err != nil {
+			continue
+		}
+		if byTop[top] == nil {
+			byTop[top] = make(map[string]string)
+		}
+		byTop[top][filepath.ToSlash(rel)] = path
+	}
+
+	clean := make(map[string]string)
+	for top, rels := range byTop {
+		var pathspecs []string
+		for rel := range rels {
+			pathspecs = append(pathspecs, rel)
+		}
+
+		for len(pathspecs) > 0 {
+			n := len(pathspecs)
+			if n > gitPathspecBatch {
+				n = gitPathspecBatch
+			}
+			batch := pathspecs[:n]
+			pathspecs = pathspecs[n:]
+
+			blobs, err := gitLsFiles(top, batch)
+			if err != nil {
+				continue
+			}
+			dirty, err := gitDiffFiles(top, batch)
+			if err != nil {
+				continue
+			}
+			for rel, blob := range blobs {
+				if !dirty[rel] {
+					clean[rels[rel]] = blob
+				}
+			}
+		}
+	}
+	return clean
+}
+
+// gitLsFiles maps the merged index entries of pathspecs to their blob ids.
+func gitLsFiles(top string, pathspecs []string) (map[string]string, error) {
+	out, err := gitOutput(top, append([]string{"ls-files", "-s", "-z", "--"}, pathspecs...))
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[string]string)
+	for _, record := range bytes.Split(out, []byte{0}) {
+		// <mode> SP <object> SP <stage> TAB <path>
+		tab := bytes.IndexByte(record, '\t')
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(string(record[:tab]))
+		if len(fields) != 3 || fields[2] != "0" {
+			continue
+		}
+		blobs[string(record[tab+1:])] = fields[1]
+	}
+	return blobs, nil
+}
+
+// gitDiffFiles returns those of pathspecs whose working tree files differ
+// from the index. Files git merely did not refresh its stat data for are
+// reported as well; they only get hashed unnecessarily.
+func gitDiffFiles(top string, pathspecs []string) (map[string]bool, error) {
+	out, err := gitOutput(top, append([]string{"diff-files", "-z", "--name-only", "--"}, pathspecs...))
+	if err != nil {
+		return nil, err
+	}
+
+	dirty := make(map[string]bool)
+	for _, name := range bytes.Split(out, []byte{0}) {
+		if len(name) > 0 {
+			dirty[string(name)] = true
+		}
+	}
+	return dirty, nil
+}
+
+func gitOutput(top string, args []string) ([]byte, error) {
+	// literal pathspecs keep file names from being taken for globs
+	args = append([]string{"--literal-pathspecs", "-C", top}, args...)
+	return exec.Command("git", args...).Output()
+}
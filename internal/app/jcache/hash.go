@@ -0,0 +1,92 @@
+package jcache
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"lukechampine.com/blake3"
+	"os"
+	"strings"
+)
+
+const (
+	DigestSha256 = "sha256"
+	// DigestSha512_256 is faster than DigestSha256 on 64 bit CPUs
+	// without SHA extensions.
+	DigestSha512_256 = "sha512_256"
+	// DigestBlake3 is the 256 bit BLAKE3 digest. It hashes 8 chunks at
+	// once with AVX2 and is the fastest; DigestSha256 comes close on CPUs
+	// with SHA extensions, see BenchmarkHashFile.
+	DigestBlake3 = "blake3"
+	// DigestGitBlob is the object id git gives the file's content. It is
+	// used for sources only and cannot be configured.
+	DigestGitBlob = "git-blob-sha1"
+
+	DefaultHashAlgo = DigestSha256
+)
+
+// Digest is a content digest along with the algorithm computing it.
+type Digest struct {
+	Algo  string
+	Value string
+}
+
+var hashes = map[string]func() hash.Hash{
+	DigestSha256:     sha256.New,
+	DigestSha512_256: sha512.New512_256,
+	DigestBlake3:     func() hash.Hash { return blake3.New(32, nil) },
+}
+
+func (d Digest) String() string {
+	return d.Algo + ":" + d.Value
+}
+
+// ParseHashAlgo accepts the algorithms entry keys, output digests and
+// source digests can be computed with.
+func ParseHashAlgo(s string) (string, error) {
+	s = strings.ToLower(s)
+	if s == "" {
+		return DefaultHashAlgo, nil
+	}
+	if _, ok := hashes[s]; ok {
+		return s, nil
+	}
+	return DefaultHashAlgo, fmt.Errorf("unsupported hash algorithm: %s", s)
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	if algo == "" {
+		algo = DefaultHashAlgo
+	}
+	newFunc, ok := hashes[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", algo)
+	}
+	return newFunc(), nil
+}
+
+// HashFile digests the content of the file at path with algo.
+func HashFile(path, algo string) (string, error) {
+	if algo == DigestGitBlob {
+		return gitBlobFile(path)
+	}
+
+	hash, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
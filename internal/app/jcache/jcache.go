@@ -1,66 +1,316 @@
 package jcache
 
 import (
+	"archive/zip"
+	"bytes"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
 type (
 	jCache struct {
 		args             ParsedArgs
+		basePath         string
 		cachePath        string
 		sourceInfoPath   string
 		compilerInfoPath string
+		storageInfoPath  string
+		manifestPath     string
+		packPath         string
 		classesCachePath string
 		includeCachePath string
+		genCachePath     string
 		log              Logger
 		compileFunc      CompileFunc
+		tiers            []Tier
+		uploads          *uploadQueue
+		readOnly         bool
+		recache          bool
+		layout           string
+		compression      string
+		compressionLevel int
+		restoreStrategy  string
+		skipIdentical    bool
+		removeStale      bool
+		restoreMTime     string
+		sourceDateEpoch  time.Time
+		ioConcurrency    int
+		fsync            string
+		restoreVerify    bool
+		namespace        string
+		version          string
+		digests          *digestCache
+		fp               *fingerprinter
+		hashAlgo         string
+		verdicts         []FileVerdict
+		// phases accumulates the time spent in each phase of Execute.
+		phases map[string]time.Duration
+		// missReason explains why needCompilation found the entry unusable.
+		missReason string
+		report     *Report
+		tracer     *Tracer
+		// span is the span of Execute, the parent of all others.
+		span *Span
 	}
 	CompileFunc func(string, ...string) (*ExecInfo, error)
+
+	// Config configures a cache. The zero value of every field leaves the
+	// respective feature off; the jcache command takes its defaults from
+	// the configuration instead, see confDefs.
+	Config struct {
+		BasePath string
+		// Tiers are consulted in order after the local cache missed.
+		Tiers []Tier
+		// ReadOnly serves hits from the local cache but never writes to
+		// the local cache or any tier. Misses are compiled uncached.
+		ReadOnly bool
+		// Recache always compiles and overwrites existing entries.
+		Recache bool
+		// Layout of new entries' output trees. LayoutObjects deduplicates
+		// files across entries in a content-addressed object store,
+		// LayoutPacked stores every entry as a single archive.
+		Layout string
+		// Compression of new entries' output trees. Restoring handles
+		// entries of any compression.
+		Compression string
+		// CompressionLevel is the gzip level, see ParseCompressionLevel.
+		// 0 selects DefaultCompressionLevel.
+		CompressionLevel int
+		// RestoreStrategy selects how raw files are restored from the
+		// cache. Unsupported strategies fall back to copying.
+		RestoreStrategy string
+		// SkipIdentical leaves restore destinations that already hold the
+		// cached content untouched. Off by default here, unlike the
+		// restore_skip_identical default of the jcache command, as it
+		// costs hashing every existing destination.
+		SkipIdentical bool
+		// RemoveStale deletes outputs that an earlier restore wrote to the
+		// same output directory but that the restored entry lacks. It
+		// breaks incremental builds, see OutputOwner.
+		RemoveStale bool
+		// RestoreMTime is the MTime* policy for restored files. Restored
+		// files keep their permission bits regardless.
+		RestoreMTime string
+		// SourceDateEpoch clamps mtimes under MTimeSourceDateEpoch.
+		SourceDateEpoch time.Time
+		// IOConcurrency bounds the number of files read or written at
+		// once. Zero means DefaultIOConcurrency.
+		IOConcurrency int
+		// Fsync is the Fsync* policy for restored files.
+		Fsync string
+		// RestoreVerify checks the digest of restored files. Their size is
+		// checked regardless. Entries failing either check are quarantined
+		// and recompiled.
+		RestoreVerify bool
+		// GitFingerprints digests sources inside git working trees as git
+		// blobs, taking the digests of clean files from the index.
+		GitFingerprints bool
+		// HashAlgo computes entry keys and the digests of sources and
+		// outputs. Entries computed with another algorithm are misses.
+		HashAlgo string
+		// Namespace labels new entries, e.g. with the project storing
+		// them, so that they can be exported selectively.
+		Namespace string
+		// Version of jcache, recorded in new entries.
+		Version string
+		// AsyncUploads queues new entries for writable tiers instead of
+		// storing them before Execute returns. See DrainUploads.
+		AsyncUploads    bool
+		UploadQueueSize int
+		// Report, if set, is filled in by Execute. Timestamp, Cwd, Tag and
+		// fallbacks are up to the caller.
+		Report *Report
+		// Tracer, if set, records the phases of Execute, hashing and the
+		// lookups in and stores to tiers as spans.
+		Tracer *Tracer
+	}
 )
 
 func NewCache(basePath string, compileFunc CompileFunc, logger Logger, osArgs []string) (*jCache, error) {
-	args, err := ParseArgs(osArgs)
+	return NewCacheWithConfig(Config{BasePath: basePath}, compileFunc, logger, osArgs)
+}
+
+func NewCacheWithConfig(cfg Config, compileFunc CompileFunc, logger Logger, osArgs []string) (*jCache, error) {
+	if cfg.CompressionLevel != 0 {
+		if err := checkCompressionLevel(cfg.CompressionLevel); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	hashAlgo := cfg.HashAlgo
+	if hashAlgo == "" {
+		hashAlgo = DefaultHashAlgo
+	}
+	args, err := ParseArgsWithHash(osArgs, hashAlgo)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	cachePath := filepath.Join(basePath, args.UUID)
+	// every record of this invocation carries its id and the entry's key
+	invocation := uuid.New().String()
+	logger = logger.With("invocation", invocation, "key", args.UUID)
+
+	report := cfg.Report
+	if report == nil {
+		report = &Report{}
+	}
+	report.Invocation = invocation
+	report.Key = args.UUID
+	report.Compiler.Path = args.CompilerPath
+	if stat, err := os.Stat(args.CompilerPath); err == nil {
+		report.Compiler.ModTime = stat.ModTime().UTC()
+	}
+	report.Sources = len(args.Sources)
+
+	cachePath := filepath.Join(cfg.BasePath, args.UUID)
 	classesCachePath := filepath.Join(cachePath, "classes")
 	includeCachePath := filepath.Join(cachePath, "include")
+	genCachePath := filepath.Join(cachePath, "generated")
 
 	jc := &jCache{
 		compileFunc:      compileFunc,
 		args:             args,
+		basePath:         cfg.BasePath,
 		cachePath:        cachePath,
 		sourceInfoPath:   filepath.Join(cachePath, "source-info.json"),
 		compilerInfoPath: filepath.Join(cachePath, "compiler-info.json"),
+		storageInfoPath:  filepath.Join(cachePath, "storage-info.json"),
+		manifestPath:     filepath.Join(cachePath, "manifest.json"),
+		packPath:         filepath.Join(cachePath, packFileName),
 		classesCachePath: classesCachePath,
 		includeCachePath: includeCachePath,
+		genCachePath:     genCachePath,
 		log:              logger,
+		tiers:            cfg.Tiers,
+		readOnly:         cfg.ReadOnly,
+		recache:          cfg.Recache,
+		layout:           cfg.Layout,
+		compression:      cfg.Compression,
+		compressionLevel: cfg.CompressionLevel,
+		restoreStrategy:  cfg.RestoreStrategy,
+		skipIdentical:    cfg.SkipIdentical,
+		removeStale:      cfg.RemoveStale,
+		restoreMTime:     cfg.RestoreMTime,
+		sourceDateEpoch:  cfg.SourceDateEpoch,
+		ioConcurrency:    cfg.IOConcurrency,
+		fsync:            cfg.Fsync,
+		restoreVerify:    cfg.RestoreVerify,
+		namespace:        cfg.Namespace,
+		version:          cfg.Version,
+		phases:           make(map[string]time.Duration),
+		digests:          loadDigestCache(cfg.BasePath),
+		hashAlgo:         hashAlgo,
+		report:           report,
+		tracer:           cfg.Tracer,
+	}
+	if jc.layout == "" {
+		jc.layout = LayoutTree
+	}
+	if jc.compression == "" {
+		jc.compression = CompressionNone
+	}
+	if jc.ioConcurrency < 1 {
+		jc.ioConcurrency = DefaultIOConcurrency()
+	}
+	if jc.compressionLevel == 0 {
+		jc.compressionLevel = DefaultCompressionLevel
+	}
+	jc.fp = newFingerprinter(jc.digests, jc.ioConcurrency, hashAlgo, cfg.GitFingerprints)
+	if cfg.AsyncUploads {
+		jc.uploads = newUploadQueue(cfg.BasePath, cfg.UploadQueueSize)
 	}
 
 	jc.mkDirs()
+	if !jc.readOnly {
+		if err := recordCacheFormat(cfg.BasePath, hashAlgo); err != nil {
+			logger.Warn("failed to record cache format - %+v", err)
+		}
+	}
 
 	return jc, nil
 }
 
 func (j *jCache) Execute() (info *ExecInfo, err error) {
 	executeStart := time.Now()
+	j.span = j.tracer.Start("jcache", nil)
+	j.span.SetAttr("jcache.key", j.args.UUID)
+	j.span.SetAttr("jcache.sources", len(j.args.Sources))
 
 	j.log.Info("%v", j.args.OriginalArgs)
+
+	start := time.Now()
+	needCompilation := j.recache || j.needCompilation()
+	if j.recache {
+		j.missReason = "recache"
+	}
+	tierHit := false
+	if needCompilation && !j.recache && !j.readOnly && j.fetchFromTiers() {
+		needCompilation = j.needCompilation()
+		tierHit = !needCompilation
+	}
+	j.phase("lookup", start)
+
 	defer func() {
+		j.updateStats(func(s *Stats) {
+			if s.Phases == nil {
+				s.Phases = make(map[string]time.Duration)
+			}
+			for name, d := range j.phases {
+				s.Phases[name] += d
+			}
+
+			if needCompilation {
+				s.Misses++
+				return
+			}
+			s.Hits++
+			if tierHit {
+				s.TierHits++
+			}
+		})
+
+		if !j.readOnly {
+			if err := j.digests.save(); err != nil {
+				j.log.Warn("failed to save digest cache - %+v", err)
+			}
+		}
+
+		j.report.Outcome = OutcomeHit
+		switch {
+		case needCompilation && j.readOnly:
+			j.report.Outcome = OutcomeUncacheable
+			j.report.Reason = "read-only cache, " + j.missReason
+		case needCompilation:
+			j.report.Outcome = OutcomeMiss
+			j.report.Reason = j.missReason
+		case tierHit:
+			j.report.Reason = "shared cache"
+		}
+		j.report.Phases = j.phases
+		if info != nil {
+			j.report.Exit = info.Exit
+		}
+
+		j.span.SetAttr("jcache.outcome", j.report.Outcome)
+		j.span.SetAttr("jcache.reason", j.report.Reason)
+		j.span.SetAttr("jcache.exit", j.report.Exit)
+		j.span.SetError(err)
+		j.span.End()
+
 		elapsed := time.Since(executeStart)
-		j.log.Info("jCache finished in %+v\n.\n.\n.", elapsed)
+		j.log.With("outcome", j.report.Outcome, "duration_ms", millis(elapsed)).
+			Info("jCache finished in %+v\n.\n.\n.", elapsed)
 	}()
 
-	start := time.Now()
-	needCompilation := j.needCompilation()
-	j.log.Info("determining cache state finished in %v", time.Since(start))
+	if needCompilation && j.readOnly {
+		// nothing to copy. javac writes to the requested locations itself
+		return j.compileUncached()
+	}
 
 	if needCompilation {
 		info, err = j.compile()
@@ -68,18 +318,44 @@ func (j *jCache) Execute() (info *ExecInfo, err error) {
 			return
 		}
 	} else {
-		j.log.Info("cache hit")
+		j.log.With("outcome", "hit").Info("cache hit")
 	}
 
 	// here we'll just copy
 	copyStart := time.Now()
 	nFiles, nBytes, err := j.copyCachedFiles()
-	j.log.Info("copying files finished in %v", time.Since(copyStart))
+	j.phase("restore", copyStart)
+	if IsCorruptEntry(err) && !needCompilation {
+		j.log.Warn("cached entry is corrupt - %+v", err)
+		needCompilation = true
+		j.missReason = "corrupt entry"
+		if j.readOnly {
+			return j.compileUncached()
+		}
+		j.quarantine(err)
+		if info, err = j.compile(); err != nil {
+			return
+		}
+		copyStart = time.Now()
+		nFiles, nBytes, err = j.copyCachedFiles()
+		j.phase("restore", copyStart)
+	}
 	if err != nil {
 		return
 	}
 
 	j.log.Info("served %d bytes compiled from %d source files", nBytes, nFiles)
+	j.report.RestoredBytes = nBytes
+
+	if !needCompilation && !j.readOnly {
+		if err := recordHit(j.cachePath); err != nil {
+			j.log.Warn("failed to record hit of %s - %+v", j.cachePath, err)
+		}
+	}
+
+	if j.removeStale {
+		j.removeStaleOutputs()
+	}
 
 	if info == nil {
 		// load compiler-info from disk if we had a cache hit
@@ -96,12 +372,20 @@ func (j *jCache) compile() (info *ExecInfo, err error) {
 		return nil, errors.WithStack(err)
 	}
 
-	j.log.Info("cache miss")
+	j.log.With("outcome", "miss").Info("cache miss")
 	j.log.Debug("unlink %s", j.cachePath)
 	os.RemoveAll(j.cachePath)
 	j.mkDirs()
 
-	err = MarshalFileInfoSlice(j.args.Sources, j.sourceInfoPath)
+	span := j.tracer.Start("hash", j.span)
+	infoSlice, err := j.sourceInfos()
+	span.SetAttr("jcache.sources", len(j.args.Sources))
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return
+	}
+	err = MarshalFileInfoSlice(infoSlice, j.sourceInfoPath)
 	if err != nil {
 		return
 	}
@@ -119,15 +403,209 @@ func (j *jCache) compile() (info *ExecInfo, err error) {
 		return nil, err
 	}
 
-	j.log.Info("javac finished in %v", time.Since(start))
+	j.phase("compile", start)
+
+	// compiler-info.json marks the entry complete. Everything else
+	// has to be in place before it is written.
+	entryInfo := newEntryInfo(j.namespace, j.version,
+		append([]string{j.args.CompilerPath}, j.args.OriginalArgs...))
+	err = j.storeOutputs(ci, entryInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordEntryFormat(j.cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = MarshalEntryInfo(entryInfo, entryInfoPath(j.cachePath))
+	if err != nil {
+		return nil, err
+	}
 
 	err = MarshalExecInfo(ci, j.compilerInfoPath)
 	if err != nil {
 		return nil, err
 	}
 
+	j.storeToTiers()
+
 	return ci, nil
 }
+
+func (j *jCache) storeOutputs(ci *ExecInfo, info *EntryInfo) (err error) {
+	start := time.Now()
+	trees := []string{"classes", "include", "generated"}
+	si := &StorageInfo{Layout: j.layout, Compression: j.compression, HashAlgo: j.hashAlgo}
+	var manifest []ManifestEntry
+	switch j.layout {
+	case LayoutPacked:
+		// the archive carries all metadata, see copyPack
+		extra := make(map[string][]byte)
+		for name, v := range map[string]interface{}{
+			"compiler-info.json": ci,
+			formatFileName:       &EntryFormat{Version: FormatVersion},
+			entryInfoFileName:    info,
+		} {
+			var buf bytes.Buffer
+			if err = NewEncoder(&buf).Encode(v); err != nil {
+				return errors.WithStack(err)
+			}
+			extra[name] = buf.Bytes()
+		}
+		manifest, si.RawBytes, si.StoredBytes, err = packEntry(j.cachePath, j.packPath,
+			append(trees, "source-info.json"), extra,
+			j.compression, j.compressionLevel, j.hashAlgo)
+		if err != nil {
+			return err
+		}
+		for _, root := range []string{j.classesCachePath, j.includeCachePath, j.genCachePath} {
+			if err = os.RemoveAll(root); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	case LayoutObjects:
+		manifest, si.RawBytes, si.StoredBytes, err = storeObjects(j.cachePath,
+			trees, j.compression, j.compressionLevel, j.hashAlgo)
+	default:
+		manifest, si.RawBytes, si.StoredBytes, err = storeAll(j.cachePath,
+			trees, j.compression, j.compressionLevel, j.hashAlgo)
+	}
+	if err != nil {
+		return err
+	}
+	j.log.Info("stored %d bytes as %d bytes (%s, %s)",
+		si.RawBytes, si.StoredBytes, si.Layout, si.Compression)
+	j.phase("store", start)
+
+	err = MarshalManifest(manifest, j.manifestPath)
+	if err != nil {
+		return err
+	}
+	return MarshalStorageInfo(si, j.storageInfoPath)
+}
+
+// sourceInfos digests all sources, reading only those neither the digest
+// cache nor a git index know in their current state.
+func (j *jCache) sourceInfos() ([]FileInfo, error) {
+	algos := j.fp.algos(j.args.Sources)
+	digests, stats, errs := j.fp.fingerprint(j.args.Sources, algos)
+
+	infoSlice := make([]FileInfo, len(j.args.Sources))
+	for i, src := range j.args.Sources {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		infoSlice[i] = newFileInfo(src, stats[i], Digest{Algo: algos[i], Value: digests[i]})
+	}
+	return infoSlice, nil
+}
+
+// phase logs the time spent in the phase name since start, adds it to
+// the phase timings recorded in the stats and traces it.
+func (j *jCache) phase(name string, start time.Time) {
+	d := time.Since(start)
+	j.tracer.startAt(name, j.span, start).endAt(start.Add(d))
+	j.log.With("phase", name, "duration_ms", millis(d)).Info("phase %s finished in %v", name, d)
+	j.phases[name] += d
+}
+
+// millis converts d to fractional milliseconds for structured logs.
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (j *jCache) updateStats(update func(*Stats)) {
+	if j.readOnly {
+		return
+	}
+	if err := updateStats(j.basePath, update); err != nil {
+		j.log.Warn("failed to update stats - %+v", err)
+	}
+}
+
+func (j *jCache) fetchFromTiers() bool {
+	for _, tier := range j.tiers {
+		if !tier.Mode().CanRead() {
+			continue
+		}
+
+		start := time.Now()
+		span := j.tracer.Start("remote.fetch", j.span)
+		ok, err := tier.Fetch(j.args.UUID, j.cachePath)
+		span.SetAttr("jcache.tier", tier.Name())
+		span.SetAttr("jcache.hit", ok)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			j.log.Warn("failed to fetch %s from %s - %+v", j.args.UUID, tier.Name(), err)
+			continue
+		}
+		if ok {
+			j.log.Info("fetched %s from %s in %v", j.args.UUID, tier.Name(), time.Since(start))
+			j.mkDirs()
+			return true
+		}
+	}
+	return false
+}
+
+func (j *jCache) storeToTiers() {
+	for _, tier := range j.tiers {
+		if !tier.Mode().CanWrite() {
+			continue
+		}
+
+		if j.uploads != nil {
+			j.queueUpload(tier)
+			continue
+		}
+
+		start := time.Now()
+		span := j.tracer.Start("remote.store", j.span)
+		err := tier.Store(j.args.UUID, j.cachePath)
+		span.SetAttr("jcache.tier", tier.Name())
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			// a shared tier must never fail the build
+			j.log.Warn("failed to store %s to %s - %+v", j.args.UUID, tier.Name(), err)
+			continue
+		}
+		j.log.Info("stored %s to %s in %v", j.args.UUID, tier.Name(), time.Since(start))
+	}
+}
+func (j *jCache) queueUpload(tier Tier) {
+	dropped, err := j.uploads.push(j.args.UUID, tier.Name(), j.cachePath)
+	if err != nil {
+		j.log.Warn("failed to queue upload of %s to %s - %+v", j.args.UUID, tier.Name(), err)
+		return
+	}
+	for _, up := range dropped {
+		j.log.Warn("upload queue full. dropped upload of %s to %s", up.Key, up.Tier)
+	}
+	j.log.Info("queued upload of %s to %s", j.args.UUID, tier.Name())
+}
+func (j *jCache) compileUncached() (*ExecInfo, error) {
+	j.log.With("outcome", "miss").Info("cache miss. read-only cache, compiling uncached")
+
+	start := time.Now()
+	defer j.phase("compile", start)
+
+	if len(j.args.FlatArgs) == 0 {
+		return j.compileNoArgs()
+	}
+
+	filename, err := writeArgsToTmpFile(j.args.FlatArgs)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(filename)
+
+	j.log.Info("%s %s\n", j.args.CompilerPath, "@"+filename)
+	return j.compileFunc(j.args.CompilerPath, "@"+filename)
+}
 func (j *jCache) compileWithArgs() (*ExecInfo, error) {
 	filename, err := j.writeArgsToTmpFile()
 	if err != nil {
@@ -152,88 +630,314 @@ func (j *jCache) repackArgs() []string {
 	repacked = redirectArgOption(repacked, "-d", j.classesCachePath, true)
 	// adding -h changes the behaviour of javac (v1.8+). We don't want that
 	repacked = redirectArgOption(repacked, "-h", j.includeCachePath, false)
+	repacked = redirectArgOption(repacked, "-s", j.genCachePath, false)
 	return repacked
 }
+
+// dstDirs maps the output trees of an entry to the directories they are
+// restored to.
+func (j *jCache) dstDirs() map[string]string {
+	return map[string]string{
+		"classes":   j.args.DstDir,
+		"include":   j.args.IncDir,
+		"generated": j.args.GenDir,
+	}
+}
+
 func (j *jCache) copyCachedFiles() (nFiles int, nBytes int64, err error) {
-	const N = 2
+	si := &StorageInfo{Layout: LayoutTree, Compression: CompressionNone}
+	if !DoesNotExist(j.storageInfoPath) {
+		si, err = UnmarshalStorageInfo(j.storageInfoPath)
+		if err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(N)
-	f := make([]int, N)
-	b := make([]int64, N)
-	e := make([]error, N)
+	dstDirs := j.dstDirs()
 
-	go func() {
-		f[0], b[0], e[0] = copyAll(j.classesCachePath, j.args.DstDir)
-		wg.Done()
-	}()
-	go func() {
-		f[1], b[1], e[1] = copyAll(j.includeCachePath, j.args.IncDir)
-		wg.Done()
+	r := newRestorer(j.restoreStrategy)
+	r.skip = j.skipIdentical
+	r.algo = si.HashAlgo
+	r.mtime, r.mtimeAt = j.mtimePolicy()
+	r.verify = j.restoreVerify
+	if !DoesNotExist(j.manifestPath) {
+		manifest, err := loadManifest(j.manifestPath)
+		if err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+		r.index(manifest, dstDirs)
+	}
+	defer func() {
+		if fellBack := r.fellBack(); len(fellBack) > 0 {
+			j.log.Info("restore strategies %v not supported here. fell back", fellBack)
+		}
+		written, skipped := r.counts()
+		j.log.Info("wrote %d files, skipped %d identical files", written, skipped)
+		j.report.RestoredFiles, j.report.SkippedFiles = written, skipped
 	}()
 
-	wg.Wait()
+	start := time.Now()
+	var jobs []restoreJob
+	switch si.Layout {
+	case LayoutPacked:
+		var zr *zip.ReadCloser
+		if zr, err = zip.OpenReader(j.packPath); err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+		defer zr.Close()
+		jobs, err = packJobs(&zr.Reader, j.packPath, dstDirs, r)
+	case LayoutObjects:
+		jobs, err = objectJobs(j.cachePath, si.Compression, dstDirs, r)
+	default:
+		cp := restoreFunc(si.Compression, r)
+		trees := map[string]string{
+			"classes":   j.classesCachePath,
+			"include":   j.includeCachePath,
+			"generated": j.genCachePath,
+		}
+		for tree, root := range trees {
+			tj, err := treeJobs(root, dstDirs[tree], cp)
+			if err != nil {
+				return 0, 0, err
+			}
+			jobs = append(jobs, tj...)
+		}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	j.phase("restore.plan", start)
+
+	p := &pipeline{workers: j.ioConcurrency, fsync: j.fsync, phase: j.phase}
+	nFiles, nBytes, err = p.run(jobs)
+	if err == nil && r.missing() > 0 {
+		err = corruptEntry(j.cachePath, "%d files of the manifest missing", r.missing())
+	}
+	return
+}
+
+// quarantine moves the entry, and the object corruptErr blames if any,
+// out of the way of the compilation replacing them, keeping them for
+// inspection. Objects are shared; the new entry would reuse a corrupt one.
+func (j *jCache) quarantine(corruptErr error) {
+	paths := []string{j.cachePath}
+	ce, ok := errors.Cause(corruptErr).(ErrCorruptEntry)
+	if ok && strings.HasPrefix(ce.Path, objectsDir(j.cachePath)+string(filepath.Separator)) {
+		paths = append(paths, ce.Path)
+	}
 
-	for _, err = range e {
+	for _, path := range paths {
+		rel, err := filepath.Rel(j.basePath, path)
+		if err == nil {
+			err = quarantine(j.basePath, rel)
+		}
 		if err != nil {
-			return
+			j.log.Warn("failed to quarantine %s - %+v", path, err)
+			continue
+		}
+		j.log.Info("quarantined %s", path)
+	}
+}
+
+// mtimePolicy resolves the time restoreMTime refers to. Policies lacking
+// their time degrade to the closest one that does not need it.
+func (j *jCache) mtimePolicy() (string, time.Time) {
+	switch j.restoreMTime {
+	case MTimeSourceDateEpoch:
+		if j.sourceDateEpoch.IsZero() {
+			j.log.Warn("SOURCE_DATE_EPOCH not set. preserving mtimes unclamped")
+			return MTimePreserve, time.Time{}
+		}
+		return MTimeSourceDateEpoch, j.sourceDateEpoch
+	case MTimeNewestSource:
+		var newest time.Time
+		for _, src := range j.args.Sources {
+			stat, err := os.Stat(src)
+			if err != nil {
+				j.log.Warn("failed to stat %s - %+v", src, err)
+				continue
+			}
+			if stat.ModTime().After(newest) {
+				newest = stat.ModTime()
+			}
+		}
+		if newest.IsZero() {
+			return MTimeNow, time.Time{}
 		}
+		return MTimeNewestSource, newest
+	case "":
+		return MTimeNow, time.Time{}
 	}
+	return j.restoreMTime, time.Time{}
+}
 
-	for _, n := range f {
-		nFiles += n
+// removeStaleOutputs is best effort. Failing to clean up leaves extra
+// files behind, just like restoring without cleanup does.
+func (j *jCache) removeStaleOutputs() {
+	if DoesNotExist(j.manifestPath) {
+		j.log.Info("entry has no manifest. not removing stale outputs")
+		return
 	}
-	for _, n := range b {
-		nBytes += n
+	manifest, err := loadManifest(j.manifestPath)
+	if err != nil {
+		j.log.Warn("failed to unmarshal %s - %+v", j.manifestPath, err)
+		return
 	}
 
-	return
+	unit := outputUnit(j.args)
+	for dir, files := range outputFiles(manifest, j.dstDirs()) {
+		removed, err := removeStaleOutputs(dir, OutputOwner{Key: j.args.UUID, Unit: unit, Files: files})
+		for _, path := range removed {
+			j.log.Debug("removed stale output %s", path)
+		}
+		if err != nil {
+			j.log.Warn("failed to remove stale outputs from %s - %+v", dir, err)
+		}
+	}
 }
 
 func (j *jCache) needCompilation() bool {
 	if j.anyFileNotExists(j.cachePath, j.sourceInfoPath, j.compilerInfoPath) {
+		j.missReason = "no entry"
+		return true
+	}
+
+	if !j.entryUpToDate() {
+		j.missReason = "unusable entry format"
+		return true
+	}
+
+	if algo := j.entryHashAlgo(); algo != j.hashAlgo {
+		j.log.Info("hash algorithm mismatch\n"+
+			"configured: %s\n"+
+			"cached:     %s",
+			j.hashAlgo, algo)
+		j.missReason = "hash algorithm mismatch"
 		return true
 	}
 
 	// see if any modified.....
 	infoSlice, err := UnmarshalFileInfoSlice(j.sourceInfoPath)
 	if err != nil {
-		j.log.Info("failed to unmarshal %s - %+v", j.sourceInfoPath, err)
+		j.log.Warn("failed to unmarshal %s - %+v", j.sourceInfoPath, err)
+		j.missReason = "unreadable source info"
 		return true
 	}
 
-	for _, info := range infoSlice {
-		stat, err := os.Stat(info.Path)
-		if err != nil {
-			j.log.Info("failed to stat %s - %+v", info.Path, err)
-			return true
+	recorded, err := os.Stat(j.sourceInfoPath)
+	if err != nil {
+		j.log.Warn("failed to stat %s - %+v", j.sourceInfoPath, err)
+		j.missReason = "unreadable source info"
+		return true
+	}
+
+	span := j.tracer.Start("hash", j.span)
+	j.verdicts = validateSources(infoSlice, recorded.ModTime(), j.fp)
+	span.SetAttr("jcache.sources", len(infoSlice))
+	span.End()
+
+	counts := make(map[string]int)
+	refresh := false
+	for _, v := range j.verdicts {
+		counts[v.Verdict]++
+		if v.Reason != "" {
+			j.log.Info("%s %s (%s)", v.Verdict, v.Path, v.Reason)
+			refresh = true
 		}
+	}
+	j.log.Info("validated %d sources: %d unchanged, %d touched, %d modified, %d missing",
+		len(j.verdicts), counts[VerdictUnchanged], counts[VerdictTouched],
+		counts[VerdictModified], counts[VerdictMissing])
 
-		tStat := stat.ModTime().UTC()
-		tInfo := info.ModTime.UTC()
-		if !tStat.Equal(tInfo) {
-			j.log.Info("modified time mismatch %s\n"+
-				"modified: %v\n"+
-				"cached:   %v",
-				info.Path, tStat, tInfo)
+	if counts[VerdictModified] > 0 {
+		j.missReason = "sources modified"
+		return true
+	}
+	if counts[VerdictMissing] > 0 {
+		j.missReason = "sources missing"
+		return true
+	}
+	if refresh && !j.readOnly {
+		// spare the next invocation from verifying the same files again
+		j.refreshSourceInfo()
+	}
+	return false
+}
 
-			hash, err := Sha256File(info.Path)
-			if err != nil {
-				j.log.Info("failed to sha256 sum %s - %+v", info.Path, err)
-				return true
-			}
+// entryUpToDate migrates an entry of an older format in place. Entries it
+// cannot migrate and entries of a newer format are misses.
+func (j *jCache) entryUpToDate() bool {
+	version, err := entryVersion(j.cachePath)
+	if err != nil {
+		j.log.Warn("failed to determine format of %s - %+v", j.cachePath, err)
+		return false
+	}
 
-			if hash == info.Sha256 {
-				j.log.Info("found identical digest for %s.", info.Path)
-				return false
-			}
+	switch {
+	case version == FormatVersion:
+		return true
+	case version > FormatVersion:
+		j.log.Info("entry format %d is newer than %d", version, FormatVersion)
+		return false
+	case j.readOnly:
+		j.log.Info("entry format %d is outdated. not migrating read-only cache", version)
+		return false
+	}
 
-			return true
-		}
+	if err = migrateEntry(j.cachePath, version); err != nil {
+		j.log.Warn("failed to migrate %s from format %d - %+v", j.cachePath, version, err)
+		return false
 	}
+	j.log.Info("migrated entry from format %d to %d", version, FormatVersion)
+	return true
+}
 
-	return false
+// entryHashAlgo returns the hash algorithm the entry was stored with.
+func (j *jCache) entryHashAlgo() string {
+	if DoesNotExist(j.storageInfoPath) {
+		return DigestSha256
+	}
+	si, err := UnmarshalStorageInfo(j.storageInfoPath)
+	if err != nil {
+		j.log.Warn("failed to unmarshal %s - %+v", j.storageInfoPath, err)
+		return ""
+	}
+	if si.HashAlgo == "" {
+		return DigestSha256
+	}
+	return si.HashAlgo
+}
+
+// SourceVerdicts returns the verdicts of the last source validation.
+func (j *jCache) SourceVerdicts() []FileVerdict {
+	return j.verdicts
 }
+
+// refreshSourceInfo records the current state of the sources validated as
+// unchanged in content. Readers see either the old or the new record.
+func (j *jCache) refreshSourceInfo() {
+	infoSlice := make([]FileInfo, len(j.verdicts))
+	for i, v := range j.verdicts {
+		infoSlice[i] = v.Info
+	}
+
+	tmp, err := ioutil.TempFile(j.cachePath, ".source-info-")
+	if err != nil {
+		j.log.Warn("failed to refresh %s - %+v", j.sourceInfoPath, err)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = MarshalFileInfoSlice(infoSlice, tmp.Name())
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.sourceInfoPath)
+	}
+	if err != nil {
+		j.log.Warn("failed to refresh %s - %+v", j.sourceInfoPath, err)
+	}
+}
+
 func (j *jCache) anyFileNotExists(filenames ...string) bool {
 	anyNotExists := false
 	for _, filename := range filenames {
@@ -245,14 +949,22 @@ func (j *jCache) anyFileNotExists(filenames ...string) bool {
 	return anyNotExists
 }
 
-func (j *jCache) mkDirs() error {
-	err := os.MkdirAll(j.classesCachePath, os.ModePerm)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	err = os.MkdirAll(j.includeCachePath, os.ModePerm)
-	if err != nil {
-		return errors.WithStack(err)
+func (j *jCache) mkDirs() (err error) {
+	if !j.readOnly {
+		err = os.MkdirAll(j.classesCachePath, os.ModePerm)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = os.MkdirAll(j.includeCachePath, os.ModePerm)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if j.args.GenDir != "" {
+			err = os.MkdirAll(j.genCachePath, os.ModePerm)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
 	}
 
 	if j.args.DstDir != "" {
@@ -0,0 +1,109 @@
+package jcache
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockPollInterval = 50 * time.Millisecond
+	lockStaleAfter   = 5 * time.Minute
+)
+
+type (
+	lockFile struct {
+		path string
+		stat os.FileInfo
+	}
+	ErrLockTimeout struct {
+		error
+		Path string
+	}
+)
+
+// acquireLock creates the lock file at path. The lock is taken by hard-linking
+// a uniquely named temporary file to path, which is atomic on NFS as opposed to
+// O_EXCL on older NFS versions. Locks older than lockStaleAfter are broken.
+func acquireLock(path string, timeout time.Duration) (*lockFile, error) {
+	host, _ := os.Hostname()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fmt.Fprintf(tmp, "%s %d\n", host, os.Getpid())
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if stat, ok := tryLink(tmp.Name(), path); ok {
+			return &lockFile{path, stat}, nil
+		}
+
+		if stat, err := os.Stat(path); err == nil && time.Since(stat.ModTime()) > lockStaleAfter {
+			// holder died without cleaning up
+			breakLock(path, stat)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout{
+				error: errors.New("timed out waiting for lock"),
+				Path:  path,
+			}
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func tryLink(tmp, path string) (os.FileInfo, bool) {
+	// link(2) may report failure over NFS although it succeeded.
+	// The only reliable check is whether both names refer to the same file.
+	os.Link(tmp, path)
+
+	tmpStat, err := os.Stat(tmp)
+	if err != nil {
+		return nil, false
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	return stat, os.SameFile(tmpStat, stat)
+}
+
+// breakLock removes the stale lock at path. Another process may have
+// broken it and taken the lock since stale was observed, so the lock is
+// renamed aside first and only removed if it still is the stale one.
+func breakLock(path string, stale os.FileInfo) {
+	aside := fmt.Sprintf("%s.stale-%s", path, uuid.New())
+	if err := os.Rename(path, aside); err != nil {
+		return
+	}
+	if stat, err := os.Stat(aside); err == nil && !os.SameFile(stat, stale) {
+		// not ours to break; put it back
+		os.Link(aside, path)
+	}
+	os.Remove(aside)
+}
+
+// Release removes the lock, unless it was broken and taken by another
+// process meanwhile.
+func (l *lockFile) Release() error {
+	stat, err := os.Stat(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	if !os.SameFile(stat, l.stat) {
+		return nil
+	}
+	return errors.WithStack(os.Remove(l.path))
+}
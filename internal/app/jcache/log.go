@@ -1,71 +1,247 @@
 package jcache
 
 import (
+	"context"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
-type Logger interface {
-	Info(format string, args ...interface{})
-	Debug(format string, args ...interface{})
-	log(skip int, level, format string, args ...interface{})
+const (
+	// LogFormatText writes "[LEVEL] file:line: message" lines.
+	LogFormatText = "text"
+	// LogFormatJSON writes JSON lines carrying the attributes of records,
+	// e.g. the invocation id, the key, the phase and its duration.
+	LogFormatJSON = "json"
+
+	DefaultLogMaxSize  = 10 << 20
+	DefaultLogMaxFiles = 3
+
+	logRotateLockTimeout = 2 * time.Second
+)
+
+type (
+	// Logger logs printf style messages. Any slog.Handler can be plugged
+	// in with NewHandlerLogger.
+	Logger interface {
+		Debug(format string, args ...interface{})
+		Info(format string, args ...interface{})
+		Warn(format string, args ...interface{})
+		Error(format string, args ...interface{})
+		// With returns a Logger adding the attributes args, alternating
+		// keys and values, to every record.
+		With(args ...interface{}) Logger
+	}
+
+	handlerLogger struct {
+		h slog.Handler
+	}
+
+	// textHandler writes records in the text format. Attributes are left
+	// out; the messages carry what humans need.
+	textHandler struct {
+		out   io.Writer
+		level slog.Leveler
+	}
+
+	// multiHandler passes records on to all of its handlers.
+	multiHandler []slog.Handler
+
+	// loggerHandler adapts a Logger implemented elsewhere to slog.Handler,
+	// so that it can be chained.
+	loggerHandler struct {
+		l Logger
+	}
+
+	syncedWriter struct {
+		mu sync.Mutex
+		w  io.Writer
+	}
+
+	// rotatingFile appends to the file at path. Once the file would grow
+	// beyond maxSize, it is renamed to path.1, path.1 to path.2 and so
+	// forth, keeping at most maxFiles old files.
+	rotatingFile struct {
+		mu       sync.Mutex
+		path     string
+		maxSize  int64
+		maxFiles int
+		file     *os.File
+	}
+)
+
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unsupported log level: %s", s)
 }
 
-type logger struct {
-	id  string
-	out io.Writer
+func ParseLogFormat(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", LogFormatText:
+		return LogFormatText, nil
+	case LogFormatJSON:
+		return LogFormatJSON, nil
+	}
+	return LogFormatText, fmt.Errorf("unsupported log format: %s", s)
 }
 
+// NewLogger logs records of all levels to out in the text format.
 func NewLogger(out io.Writer) Logger {
-	l := logger{
-		id:  uuid.New().String(),
-		out: out,
+	return NewFormatLogger(out, LogFormatText, slog.LevelDebug)
+}
+
+// NewFormatLogger logs records of level and above to out in format.
+func NewFormatLogger(out io.Writer, format string, level slog.Level) Logger {
+	if format == LogFormatJSON {
+		return NewHandlerLogger(slog.NewJSONHandler(out, &slog.HandlerOptions{
+			AddSource: true,
+			Level:     level,
+		}))
 	}
-	return &l
+	return NewHandlerLogger(&textHandler{out: out, level: level})
+}
+
+// NewHandlerLogger logs to h, e.g. the handler of an application's own
+// slog.Logger.
+func NewHandlerLogger(h slog.Handler) Logger {
+	return &handlerLogger{h}
+}
+
+func (l *handlerLogger) Debug(format string, args ...interface{}) {
+	l.log(slog.LevelDebug, format, args...)
+}
+func (l *handlerLogger) Info(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, format, args...)
+}
+func (l *handlerLogger) Warn(format string, args ...interface{}) {
+	l.log(slog.LevelWarn, format, args...)
 }
-func (l *logger) Info(format string, args ...interface{}) {
-	l.log(5, "INFO", format, args...)
+func (l *handlerLogger) Error(format string, args ...interface{}) {
+	l.log(slog.LevelError, format, args...)
 }
-func (l *logger) Debug(format string, args ...interface{}) {
-	l.log(5, "DEBUG", format, args...)
+func (l *handlerLogger) With(args ...interface{}) Logger {
+	return &handlerLogger{l.h.WithAttrs(argsToAttrs(args))}
 }
-func (l *logger) log(skip int, level, format string, args ...interface{}) {
+func (l *handlerLogger) log(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !l.h.Enabled(ctx, level) {
+		return
+	}
+
 	for i, arg := range args {
 		if err, ok := arg.(error); ok {
 			args[i] = errors.WithStack(err)
 		}
 	}
 
-	l.write(skip, level, fmt.Sprintf(format, args...))
+	// skip runtime.Callers, log and the level's method
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	l.h.Handle(ctx, slog.NewRecord(time.Now(), level, msg, pcs[0]))
 }
-func (l *logger) write(skip int, level, msg string) {
-	f := getCallerFrame(skip)
-	if strings.HasSuffix(msg, "\n") {
-		msg = msg[:len(msg)-1]
+
+func argsToAttrs(args []interface{}) []slog.Attr {
+	var attrs []slog.Attr
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs = append(attrs, slog.Any(fmt.Sprint(args[i]), args[i+1]))
 	}
+	return attrs
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
 	goPath := filepath.Join(os.Getenv("GOPATH"), "src")
 	file, _ := filepath.Rel(goPath, f.File)
-	traced := fmt.Sprintf("[%5s] %s:%d: %s\n", level, file, f.Line, msg)
-	io.WriteString(l.out, traced)
+	_, err := fmt.Fprintf(h.out, "[%5s] %s:%d: %s\n", r.Level, file, f.Line, r.Message)
+	return err
+}
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
 }
-func getCallerFrame(skip int) runtime.Frame {
-	pc := make([]uintptr, 15)
-	n := runtime.Callers(skip, pc)
-	frames := runtime.CallersFrames(pc[:n])
-	frame, _ := frames.Next()
-	return frame
+func (h *textHandler) WithGroup(string) slog.Handler {
+	return h
 }
 
-type syncedWriter struct {
-	mu sync.Mutex
-	w  io.Writer
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range m {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if hErr := h.Handle(ctx, r.Clone()); hErr != nil && err == nil {
+			err = hErr
+		}
+	}
+	return err
+}
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+func (h loggerHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+func (h loggerHandler) Handle(_ context.Context, r slog.Record) error {
+	switch {
+	case r.Level >= slog.LevelError:
+		h.l.Error("%s", r.Message)
+	case r.Level >= slog.LevelWarn:
+		h.l.Warn("%s", r.Message)
+	case r.Level >= slog.LevelInfo:
+		h.l.Info("%s", r.Message)
+	default:
+		h.l.Debug("%s", r.Message)
+	}
+	return nil
+}
+func (h loggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	args := make([]interface{}, 0, 2*len(attrs))
+	for _, a := range attrs {
+		args = append(args, a.Key, a.Value.Any())
+	}
+	return loggerHandler{h.l.With(args...)}
+}
+func (h loggerHandler) WithGroup(string) slog.Handler {
+	return h
 }
 
 func (s *syncedWriter) Write(p []byte) (n int, err error) {
@@ -75,36 +251,94 @@ func (s *syncedWriter) Write(p []byte) (n int, err error) {
 	return s.w.Write(p)
 }
 
-func NewFileLogger(logFile string) (Logger, error) {
-	dir := filepath.Dir(logFile)
-	err := os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
+// OpenLogFile opens the log file at path for appending. It is rotated
+// once it would grow beyond maxSize bytes, unless maxSize is 0.
+func OpenLogFile(path string, maxSize int64, maxFiles int) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return nil, err
 	}
 
-	out, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
 		return nil, err
 	}
+	return f, nil
+}
 
-	return NewLogger(&syncedWriter{sync.Mutex{}, out}), nil
+func (f *rotatingFile) open() (err error) {
+	f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	return
 }
 
-type loggerChain struct {
-	loggers []Logger
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 {
+		stat, err := f.file.Stat()
+		if err == nil && stat.Size() > 0 && stat.Size()+int64(len(p)) > f.maxSize {
+			// failing to rotate keeps appending to the current file
+			f.rotate()
+		}
+	}
+	return f.file.Write(p)
 }
 
-func NewLoggerChain(loggers ...Logger) Logger {
-	return &loggerChain{loggers}
+// rotate shifts the log files, unless another process sharing them did
+// so already, and reopens path.
+func (f *rotatingFile) rotate() error {
+	lock, err := acquireLock(f.path+".lock", logRotateLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	mine, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if cur, err := os.Stat(f.path); err == nil && os.SameFile(mine, cur) {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+		for i := f.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if f.maxFiles > 0 {
+			os.Rename(f.path, f.path+".1")
+		} else {
+			os.Remove(f.path)
+		}
+	}
+
+	f.file.Close()
+	return f.open()
 }
-func (l *loggerChain) Info(format string, args ...interface{}) {
-	l.log(5, "INFO", format, args...)
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
 }
-func (l *loggerChain) Debug(format string, args ...interface{}) {
-	l.log(5, "DEBUG", format, args...)
+
+// NewFileLogger logs records of all levels to the file at logFile in the
+// text format, rotating it at DefaultLogMaxSize.
+func NewFileLogger(logFile string) (Logger, error) {
+	out, err := OpenLogFile(logFile, DefaultLogMaxSize, DefaultLogMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(&syncedWriter{w: out}), nil
 }
-func (l *loggerChain) log(skip int, level, format string, args ...interface{}) {
-	for _, logger := range l.loggers {
-		logger.log(skip+1, level, format, args...)
+
+// NewLoggerChain logs every record to all of loggers.
+func NewLoggerChain(loggers ...Logger) Logger {
+	handlers := make(multiHandler, len(loggers))
+	for i, l := range loggers {
+		if hl, ok := l.(*handlerLogger); ok {
+			handlers[i] = hl.h
+		} else {
+			handlers[i] = loggerHandler{l}
+		}
 	}
+	return &handlerLogger{handlers}
 }
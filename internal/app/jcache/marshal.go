@@ -12,10 +12,15 @@ type (
 	EncoderFacade interface{ Encode(v interface{}) error }
 	DecoderFacade interface{ Decode(v interface{}) error }
 
+	// FileInfo records the state of a source file at compile time. Size
+	// and ChangeTime are zero in records predating them, ChangeTime also
+	// where the platform does not expose it.
 	FileInfo struct {
-		Path    string
-		ModTime time.Time
-		Sha256  string
+		Path       string
+		ModTime    time.Time
+		Size       int64
+		ChangeTime time.Time
+		Digest     Digest
 	}
 )
 
@@ -24,10 +29,11 @@ func NewEncoder(w io.Writer) EncoderFacade {
 	enc.SetIndent("", "  ")
 	return enc
 }
+
+// NewDecoder ignores fields it does not know, so that metadata files
+// written by newer versions of jcache stay readable. See FormatVersion.
 func NewDecoder(w io.Reader) DecoderFacade {
-	dec := json.NewDecoder(w)
-	dec.DisallowUnknownFields()
-	return dec
+	return json.NewDecoder(w)
 }
 
 func MarshalExecInfo(info *ExecInfo, path string) error {
@@ -53,44 +59,184 @@ func UnmarshalExecInfo(path string) (info *ExecInfo, err error) {
 	return
 }
 
-func MarshalFileInfoSlice(paths []string, outFile string) error {
-	file, err := os.Create(outFile)
+func MarshalFileInfoSlice(infoSlice []FileInfo, path string) error {
+	file, err := os.Create(path)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	defer file.Close()
 
-	var infoSlice []FileInfo
-	for _, src := range paths {
-		stat, err := os.Stat(src)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	enc := NewEncoder(file)
+	return enc.Encode(infoSlice)
+}
+func UnmarshalFileInfoSlice(path string) (infoSlice []FileInfo, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
 
-		fileDigest, err := Sha256File(src)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	dec := NewDecoder(file)
+	err = dec.Decode(&infoSlice)
+	return
+}
 
-		info := FileInfo{
-			Path:    src,
-			ModTime: stat.ModTime().UTC(),
-			Sha256:  fileDigest,
-		}
-		infoSlice = append(infoSlice, info)
+func MarshalStorageInfo(info *StorageInfo, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
 	}
+	defer file.Close()
 
 	enc := NewEncoder(file)
-	return enc.Encode(infoSlice)
+	return enc.Encode(info)
 }
-func UnmarshalFileInfoSlice(path string) (infoSlice []FileInfo, err error) {
+func UnmarshalStorageInfo(path string) (info *StorageInfo, err error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 
+	info = &StorageInfo{}
 	dec := NewDecoder(file)
-	err = dec.Decode(&infoSlice)
+	err = dec.Decode(info)
+	return
+}
+
+func MarshalManifest(manifest []ManifestEntry, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	enc := NewEncoder(file)
+	return enc.Encode(manifest)
+}
+func UnmarshalManifest(path string) (manifest []ManifestEntry, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	dec := NewDecoder(file)
+	err = dec.Decode(&manifest)
+	return
+}
+
+func MarshalOutputState(state *OutputState, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	enc := NewEncoder(file)
+	return enc.Encode(state)
+}
+func UnmarshalOutputState(path string) (state *OutputState, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	state = &OutputState{}
+	dec := NewDecoder(file)
+	err = dec.Decode(state)
+	return
+}
+
+func MarshalCacheFormat(format *CacheFormat, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	enc := NewEncoder(file)
+	return enc.Encode(format)
+}
+func UnmarshalCacheFormat(path string) (format *CacheFormat, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	format = &CacheFormat{}
+	dec := NewDecoder(file)
+	err = dec.Decode(format)
+	return
+}
+
+func MarshalEntryFormat(format *EntryFormat, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	enc := NewEncoder(file)
+	return enc.Encode(format)
+}
+func UnmarshalEntryFormat(path string) (format *EntryFormat, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	format = &EntryFormat{}
+	dec := NewDecoder(file)
+	err = dec.Decode(format)
+	return
+}
+
+func MarshalEntryInfo(info *EntryInfo, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	enc := NewEncoder(file)
+	return enc.Encode(info)
+}
+func UnmarshalEntryInfo(path string) (info *EntryInfo, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info = &EntryInfo{}
+	dec := NewDecoder(file)
+	err = dec.Decode(info)
+	return
+}
+
+func MarshalEntryUsage(usage *EntryUsage, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	enc := NewEncoder(file)
+	return enc.Encode(usage)
+}
+func UnmarshalEntryUsage(path string) (usage *EntryUsage, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	usage = &EntryUsage{}
+	dec := NewDecoder(file)
+	err = dec.Decode(usage)
 	return
 }
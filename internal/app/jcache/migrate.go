@@ -0,0 +1,178 @@
+package jcache
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type (
+	// legacyFileInfo is FileInfo as recorded by format 0.
+	legacyFileInfo struct {
+		Path       string
+		ModTime    time.Time
+		Size       int64
+		ChangeTime time.Time
+		DigestAlgo string
+		Sha256     string
+	}
+
+	// Upgrade summarizes an UpgradeCache run.
+	Upgrade struct {
+		Upgraded int
+		Current  int
+		// Newer counts entries of a format newer than FormatVersion.
+		// They are left alone.
+		Newer int
+		// Removed counts entries that could not be upgraded.
+		Removed int
+	}
+)
+
+// migrations upgrade an entry of the version they are indexed by to the
+// next one. Versions only adding files written by recordEntryFormat need
+// none.
+var migrations = map[int]func(entryPath string) error{
+	0: migrateSourceDigests,
+}
+
+func entryFormatPath(entryPath string) string {
+	return filepath.Join(entryPath, formatFileName)
+}
+
+// entryVersion returns the format of the entry at entryPath. Entries
+// predating their own format.json are told apart by their source-info.json.
+func entryVersion(entryPath string) (int, error) {
+	path := entryFormatPath(entryPath)
+	if !DoesNotExist(path) {
+		ef, err := UnmarshalEntryFormat(path)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		return ef.Version, nil
+	}
+
+	file, err := os.Open(filepath.Join(entryPath, "source-info.json"))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	var records []map[string]json.RawMessage
+	if err = NewDecoder(file).Decode(&records); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	for _, record := range records {
+		if _, ok := record["Sha256"]; ok {
+			return 0, nil
+		}
+	}
+	return 1, nil
+}
+
+// recordEntryFormat marks the entry at entryPath as being of FormatVersion.
+func recordEntryFormat(entryPath string) error {
+	return MarshalEntryFormat(&EntryFormat{Version: FormatVersion}, entryFormatPath(entryPath))
+}
+
+// migrateEntry upgrades the entry at entryPath from version to
+// FormatVersion in place. Every file is replaced atomically, so that
+// concurrent readers see either format.
+func migrateEntry(entryPath string, version int) error {
+	for v := version; v < FormatVersion; v++ {
+		if migrate, ok := migrations[v]; ok {
+			if err := migrate(entryPath); err != nil {
+				return err
+			}
+		}
+	}
+	return recordEntryFormat(entryPath)
+}
+
+// migrateSourceDigests converts the digests of source-info.json to Digest.
+// The file keeps its mtime; it serves as the time the sources were
+// recorded at.
+func migrateSourceDigests(entryPath string) error {
+	path := filepath.Join(entryPath, "source-info.json")
+	stat, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var legacy []legacyFileInfo
+	err = NewDecoder(file).Decode(&legacy)
+	file.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	infoSlice := make([]FileInfo, len(legacy))
+	for i, l := range legacy {
+		algo := l.DigestAlgo
+		if algo == "" {
+			algo = DigestSha256
+		}
+		infoSlice[i] = FileInfo{
+			Path:       l.Path,
+			ModTime:    l.ModTime,
+			Size:       l.Size,
+			ChangeTime: l.ChangeTime,
+			Digest:     Digest{Algo: algo, Value: l.Sha256},
+		}
+	}
+
+	tmp, err := ioutil.TempFile(entryPath, ".source-info-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err = MarshalFileInfoSlice(infoSlice, tmp.Name()); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmp.Name(), stat.ModTime(), stat.ModTime()); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
+
+// UpgradeCache migrates all complete entries below basePath to
+// FormatVersion in place and removes those it fails to migrate.
+func UpgradeCache(basePath string) (u Upgrade, err error) {
+	keys, err := completeEntries(basePath)
+	if err != nil {
+		return u, err
+	}
+
+	for _, key := range keys {
+		entryPath := filepath.Join(basePath, key)
+		version, err := entryVersion(entryPath)
+		switch {
+		case err == nil && version == FormatVersion:
+			u.Current++
+		case err == nil && version > FormatVersion:
+			u.Newer++
+		case err == nil && migrateEntry(entryPath, version) == nil:
+			u.Upgraded++
+		default:
+			if err = os.RemoveAll(entryPath); err != nil {
+				return u, errors.WithStack(err)
+			}
+			u.Removed++
+		}
+	}
+
+	hashAlgo := DefaultHashAlgo
+	if cf, err := LoadCacheFormat(basePath); err == nil && cf != nil && cf.HashAlgo != "" {
+		hashAlgo = cf.HashAlgo
+	}
+	return u, errors.WithStack(recordCacheFormat(basePath, hashAlgo))
+}
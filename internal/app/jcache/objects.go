@@ -0,0 +1,299 @@
+package jcache
+
+import (
+	"fmt"
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	LayoutTree    = "tree"
+	LayoutObjects = "objects"
+
+	objectsDirName = "objects"
+	// objects younger than this are never pruned; they may belong to an
+	// entry that is being stored right now.
+	objectPruneGrace = time.Hour
+)
+
+// ManifestEntry maps a file of an entry's output trees to the object
+// holding its content. Path is slash separated and starts with the tree,
+// e.g. classes/jcache/Foo.class. Mode and ModTime are the permission bits
+// and the mtime the compiler gave the file; they are zero for entries
+// that predate recording them.
+type ManifestEntry struct {
+	Path    string
+	Object  string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// loadManifest unmarshals the manifest at path, failing with
+// ErrCorruptEntry if any of its entries does not pass checkManifestEntry.
+func loadManifest(path string) ([]ManifestEntry, error) {
+	manifest, err := UnmarshalManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, me := range manifest {
+		if err = checkManifestEntry(me); err != nil {
+			return nil, corruptEntry(filepath.Dir(path), "manifest.json: %v", err)
+		}
+	}
+	return manifest, nil
+}
+
+// checkManifestEntry rejects paths that are not clean, relative and below
+// their output tree and objects that are not digests. Either would let an
+// entry write or read outside of where it belongs.
+func checkManifestEntry(me ManifestEntry) error {
+	if clean, ok := localPath(me.Path); !ok || clean != me.Path || !strings.Contains(clean, "/") {
+		return fmt.Errorf("%q is not a path inside an output tree", me.Path)
+	}
+	if !isDigest(me.Object) {
+		return fmt.Errorf("%s: malformed digest %q", me.Path, me.Object)
+	}
+	return nil
+}
+
+func newManifestEntry(rel, digest string, size int64, stat os.FileInfo) ManifestEntry {
+	return ManifestEntry{
+		Path:    rel,
+		Object:  digest,
+		Size:    size,
+		Mode:    stat.Mode().Perm(),
+		ModTime: stat.ModTime().UTC(),
+	}
+}
+
+func ParseLayout(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", LayoutTree:
+		return LayoutTree, nil
+	case LayoutObjects:
+		return LayoutObjects, nil
+	case LayoutPacked:
+		return LayoutPacked, nil
+	}
+	return LayoutTree, fmt.Errorf("unsupported storage layout: %s", s)
+}
+
+// objectsDir returns the object store shared by the entry at entryPath
+// and all of its siblings.
+func objectsDir(entryPath string) string {
+	return filepath.Join(filepath.Dir(entryPath), objectsDirName)
+}
+
+// objectPath shards objects by the first byte of their digest.
+func objectPath(objects, digest, compression string) string {
+	name := digest
+	if compression == CompressionGzip {
+		name += ".gz"
+	}
+	return filepath.Join(objects, digest[:2], name)
+}
+
+// storeObjects moves all files of the output trees below entryPath into
+// the object store, named by their algo digest, and returns the manifest
+// describing them.
+func storeObjects(entryPath string, trees []string, compression string, level int, algo string) (manifest []ManifestEntry, rawBytes, storedBytes int64, err error) {
+	objects := objectsDir(entryPath)
+	err = walkTrees(entryPath, trees, func(path, rel string, stat os.FileInfo) error {
+		raw, stored, digest, err := storeFile(path, compression, level, algo)
+		if err != nil {
+			return err
+		}
+
+		stored, err = storeObject(path, objectPath(objects, digest, compression), stored)
+		if err != nil {
+			return err
+		}
+
+		manifest = append(manifest, newManifestEntry(rel, digest, raw, stat))
+		rawBytes += raw
+		storedBytes += stored
+		return nil
+	})
+	return
+}
+
+// storeObject moves the stored file at path to dst, unless an object with
+// the same content is already present.
+func storeObject(path, dst string, size int64) (stored int64, err error) {
+	if stat, err := os.Stat(dst); err == nil {
+		// deduplicated. touch the object so PruneObjects keeps its hands
+		// off until our manifest references it.
+		now := time.Now()
+		os.Chtimes(dst, now, now)
+		return stat.Size(), errors.WithStack(os.Remove(path))
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return size, errors.WithStack(os.Rename(path, dst))
+}
+
+// objectJobs plans restoring every file listed in the manifest of the
+// entry at entryPath to the directory its tree is mapped to. Trees mapped
+// to "" are skipped.
+func objectJobs(entryPath, compression string, dstDirs map[string]string, r *restorer) ([]restoreJob, error) {
+	manifest, err := loadManifest(filepath.Join(entryPath, "manifest.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	objects := objectsDir(entryPath)
+	cp := restoreFunc(compression, r)
+	var jobs []restoreJob
+	for _, me := range manifest {
+		dst, ok := manifestDst(me, dstDirs)
+		if !ok {
+			continue
+		}
+		jobs = append(jobs, restoreJob{from: objectPath(objects, me.Object, compression), to: dst, cp: cp})
+	}
+	return jobs, nil
+}
+
+// copyEntry copies the entry at srcPath to dstPath. If the entry is kept
+// in an object store, the objects it references are copied between the
+// object stores next to srcPath and dstPath, skipping those already
+// present. It returns the paths of all objects it created.
+func copyEntry(srcPath, dstPath string) (created []string, err error) {
+	return transferEntry(srcPath, dstPath, copyFile, copyObject)
+}
+
+// linkEntry is copyEntry by hard links, falling back to copies where
+// linking fails. The links keep the content srcPath holds now, as entry
+// files and objects are replaced by rename rather than rewritten.
+func linkEntry(srcPath, dstPath string) (created []string, err error) {
+	return transferEntry(srcPath, dstPath, linkFile, linkObject)
+}
+
+func transferEntry(srcPath, dstPath string, cp copyFunc, cpObject func(src, dst string) error) (created []string, err error) {
+	if _, _, err = walkCopy(srcPath, dstPath, cp); err != nil {
+		return nil, err
+	}
+
+	siPath := filepath.Join(dstPath, "storage-info.json")
+	if DoesNotExist(siPath) {
+		return nil, nil
+	}
+	si, err := UnmarshalStorageInfo(siPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if si.Layout != LayoutObjects {
+		return nil, nil
+	}
+	manifest, err := loadManifest(filepath.Join(dstPath, "manifest.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	srcObjects := objectsDir(srcPath)
+	dstObjects := objectsDir(dstPath)
+	for _, me := range manifest {
+		dst := objectPath(dstObjects, me.Object, si.Compression)
+		if !DoesNotExist(dst) {
+			continue
+		}
+
+		if err = cpObject(objectPath(srcObjects, me.Object, si.Compression), dst); err != nil {
+			return created, err
+		}
+		created = append(created, dst)
+	}
+	return created, nil
+}
+
+func copyObject(src, dst string) error {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// objects are immutable once visible under their name
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err = copyFile(src, tmp.Name()); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), dst))
+}
+
+// linkObject is copyObject by a hard link, which makes dst visible with
+// its whole content at once.
+func linkObject(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return copyObject(src, dst)
+}
+
+// PruneObjects removes all objects below basePath that are not referenced
+// by any entry's manifest. It returns the number of objects and bytes freed.
+func PruneObjects(basePath string) (nObjects int, nBytes int64, err error) {
+	objects := filepath.Join(basePath, objectsDirName)
+	if DoesNotExist(objects) {
+		return 0, 0, nil
+	}
+
+	referenced := make(map[string]bool)
+	infos, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	for _, info := range infos {
+		if !info.IsDir() || !isEntryKey(info.Name()) {
+			continue
+		}
+		manifest, err := loadManifest(filepath.Join(basePath, info.Name(), "manifest.json"))
+		if err != nil {
+			continue
+		}
+		for _, me := range manifest {
+			referenced[me.Object] = true
+		}
+	}
+
+	err = godirwalk.Walk(objects, &godirwalk.Options{
+		Unsorted: true,
+		Callback: func(path string, de *godirwalk.Dirent) error {
+			if !de.IsRegular() {
+				return nil
+			}
+
+			digest := strings.TrimSuffix(filepath.Base(path), ".gz")
+			if referenced[digest] {
+				return nil
+			}
+			stat, err := os.Stat(path)
+			if err != nil || time.Since(stat.ModTime()) < objectPruneGrace {
+				return nil
+			}
+			if err = os.Remove(path); err != nil {
+				return errors.WithStack(err)
+			}
+			nObjects++
+			nBytes += stat.Size()
+			return nil
+		},
+	})
+	return
+}
@@ -0,0 +1,164 @@
+package jcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// outputStateFileName names the file that records, inside an output
+	// directory, which files jcache restored there last.
+	outputStateFileName    = ".jcache-outputs.json"
+	outputStateLockTimeout = 2 * time.Second
+)
+
+type (
+	// OutputState lists the files of an output directory that jcache
+	// owns by the entries that restored them.
+	OutputState struct {
+		Owners []OutputOwner
+	}
+	// OutputOwner is the last entry of a compilation unit restored to
+	// the directory. A unit is what the compiler is asked to do apart
+	// from the sources: its path and flags. Builds share an output
+	// directory as different units, while an entry replaces the entries
+	// of its own unit, e.g. after a source was deleted. An incremental
+	// build recompiling some of the sources is the same unit, so its
+	// entry removes the classes of all other sources.
+	OutputOwner struct {
+		Key  string
+		Unit string
+		// Files are relative to the directory and slash separated.
+		Files []string
+	}
+)
+
+// outputUnit returns the compilation unit args belong to.
+func outputUnit(args ParsedArgs) string {
+	sources := make(map[string]bool, len(args.Sources))
+	for _, src := range args.Sources {
+		sources[src] = true
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(args.CompilerPath))
+	for _, arg := range args.FlatArgs {
+		if !sources[arg] {
+			hash.Write([]byte{0})
+			hash.Write([]byte(arg))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// outputFiles groups the restore destinations of manifest by the output
+// directory they are restored to. Trees sharing a directory are merged.
+func outputFiles(manifest []ManifestEntry, dstDirs map[string]string) map[string][]string {
+	files := make(map[string][]string)
+	for _, dir := range dstDirs {
+		if dir != "" {
+			files[filepath.Clean(dir)] = nil
+		}
+	}
+	for _, me := range manifest {
+		idx := strings.IndexByte(me.Path, '/')
+		if idx < 0 {
+			continue
+		}
+		if dir := dstDirs[me.Path[:idx]]; dir != "" {
+			dir = filepath.Clean(dir)
+			files[dir] = append(files[dir], me.Path[idx+1:])
+		}
+	}
+	return files
+}
+
+// removeStaleOutputs deletes the files a previous restore of the unit of
+// owner wrote to dir that are not part of owner.Files, then records owner.
+// Files jcache did not restore itself and files other units own are never
+// touched. It returns the paths it removed.
+func removeStaleOutputs(dir string, owner OutputOwner) (removed []string, err error) {
+	statePath := filepath.Join(dir, outputStateFileName)
+	lock, err := acquireLock(statePath+".lock", outputStateLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	state := &OutputState{}
+	if !DoesNotExist(statePath) {
+		// an unreadable state only means we cannot clean up this time
+		if s, err := UnmarshalOutputState(statePath); err == nil {
+			state = s
+		}
+	}
+
+	keep := make(map[string]bool, len(owner.Files))
+	for _, f := range owner.Files {
+		keep[f] = true
+	}
+	var owners, replaced []OutputOwner
+	for _, o := range state.Owners {
+		if o.Unit == owner.Unit {
+			replaced = append(replaced, o)
+			continue
+		}
+		owners = append(owners, o)
+		for _, f := range o.Files {
+			keep[f] = true
+		}
+	}
+
+	for _, o := range replaced {
+		for _, f := range o.Files {
+			if keep[f] {
+				continue
+			}
+			path := filepath.Join(dir, filepath.FromSlash(f))
+			if err := os.Remove(path); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return removed, err
+			}
+			removed = append(removed, path)
+			removeEmptyParents(dir, path)
+		}
+	}
+
+	sort.Strings(owner.Files)
+	state.Owners = append(owners, owner)
+	return removed, writeOutputState(state, statePath)
+}
+
+// writeOutputState replaces the state at path in a single rename.
+func writeOutputState(state *OutputState, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), outputStateFileName+"-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err = MarshalOutputState(state, tmp.Name()); err != nil {
+		return err
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
+
+// removeEmptyParents removes the directories between path and dir that
+// became empty.
+func removeEmptyParents(dir, path string) {
+	for p := filepath.Dir(path); p != dir && len(p) > len(dir); p = filepath.Dir(p) {
+		if os.Remove(p) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package jcache
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/hex"
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	LayoutPacked = "packed"
+
+	packFileName = "entry.zip"
+)
+
+// packEntry writes the files and trees below entryPath named by members,
+// plus the in-memory files in extra, into a single zip archive at packPath.
+// The zip's central directory serves as the index of the entry; since it
+// also carries the entry's metadata, the archive is self-contained and can
+// be transferred as is.
+func packEntry(entryPath, packPath string, members []string, extra map[string][]byte, compression string, level int, algo string) (manifest []ManifestEntry, rawBytes, storedBytes int64, err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(packPath), ".pack-")
+	if err != nil {
+		return nil, 0, 0, errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	method := zip.Store
+	zw := zip.NewWriter(tmp)
+	if compression == CompressionGzip {
+		method = zip.Deflate
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+
+	add := func(name string, r io.Reader) (int64, error) {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		n, err := io.Copy(w, r)
+		rawBytes += n
+		return n, errors.WithStack(err)
+	}
+
+	addFile := func(path string, inTree bool) error {
+		rel, err := filepath.Rel(entryPath, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer file.Close()
+
+		if !inTree {
+			_, err = add(filepath.ToSlash(rel), file)
+			return err
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		hash, err := newHash(algo)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		n, err := add(filepath.ToSlash(rel), io.TeeReader(file, hash))
+		manifest = append(manifest, newManifestEntry(filepath.ToSlash(rel), hex.EncodeToString(hash.Sum(nil)), n, stat))
+		return err
+	}
+
+	for _, member := range members {
+		root := filepath.Join(entryPath, member)
+		stat, err := os.Stat(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, 0, 0, errors.WithStack(err)
+		}
+		if !stat.IsDir() {
+			if err = addFile(root, false); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+
+		err = godirwalk.Walk(root, &godirwalk.Options{
+			Callback: func(path string, de *godirwalk.Dirent) error {
+				if !de.IsRegular() {
+					return nil
+				}
+				return addFile(path, true)
+			},
+		})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	var buf bytes.Buffer
+	if err = NewEncoder(&buf).Encode(manifest); err != nil {
+		return nil, 0, 0, errors.WithStack(err)
+	}
+	extra["manifest.json"] = buf.Bytes()
+	for name, data := range extra {
+		if _, err = add(name, bytes.NewReader(data)); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		return nil, 0, 0, errors.WithStack(err)
+	}
+	storedBytes, err = tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, 0, errors.WithStack(err)
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, 0, 0, errors.WithStack(err)
+	}
+	return manifest, rawBytes, storedBytes, errors.WithStack(os.Rename(tmp.Name(), packPath))
+}
+
+// packJobs plans extracting the trees of the packed entry zr was opened
+// from at packPath to the directories they are mapped to. Metadata and
+// trees mapped to "" are skipped. zr must stay open until the jobs ran.
+// Members whose names escape the entry make it corrupt.
+func packJobs(zr *zip.Reader, packPath string, dstDirs map[string]string, r *restorer) ([]restoreJob, error) {
+	var jobs []restoreJob
+	for _, zf := range zr.File {
+		if clean, ok := localPath(zf.Name); !ok || clean != zf.Name {
+			return nil, corruptEntry(packPath, "member %q escapes the entry", zf.Name)
+		}
+		dst, ok := manifestDst(ManifestEntry{Path: zf.Name}, dstDirs)
+		if !ok {
+			continue
+		}
+
+		zf := zf
+		unpack := r.wrap(func(_, to string) (int64, error) {
+			return unpackFile(zf, to)
+		})
+		jobs = append(jobs, restoreJob{from: filepath.Join(packPath, zf.Name), to: dst, cp: unpack})
+	}
+	return jobs, nil
+}
+
+// copyPack copies the packed entry at srcPath to dstPath as it is
+// transferred: its archive and storage-info.json, which tells packed
+// entries apart. All other metadata is restored from the archive by
+// unpackMetadata.
+func copyPack(srcPath, dstPath string) error {
+	if err := os.MkdirAll(dstPath, os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, name := range []string{packFileName, "storage-info.json"} {
+		if _, err := copyFile(filepath.Join(srcPath, name), filepath.Join(dstPath, name)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// unpackMetadata extracts the metadata files of the packed entry at
+// entryPath from its archive. Those are the members outside of the trees.
+func unpackMetadata(entryPath string) error {
+	packPath := filepath.Join(entryPath, packFileName)
+	zr, err := zip.OpenReader(packPath)
+	if err != nil {
+		return corruptEntry(packPath, "%v", err)
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if clean, ok := localPath(zf.Name); !ok || clean != zf.Name {
+			return corruptEntry(packPath, "member %q escapes the entry", zf.Name)
+		}
+		if strings.IndexByte(zf.Name, '/') >= 0 {
+			continue
+		}
+		if _, err = unpackFile(zf, filepath.Join(entryPath, zf.Name)); err != nil {
+			return err
+		}
+	}
+	if DoesNotExist(filepath.Join(entryPath, "compiler-info.json")) {
+		return corruptEntry(packPath, "compiler-info.json missing")
+	}
+	return nil
+}
+
+func unpackFile(zf *zip.File, to string) (int64, error) {
+	src, err := zf.Open()
+	if err != nil {
+		return 0, corruptEntry(zf.Name, "%v", err)
+	}
+	defer src.Close()
+
+	dst, err := createFile(to)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, src)
+	return n, errors.WithStack(corruptUnlessPathError(zf.Name, err))
+}
@@ -1,7 +1,6 @@
 package jcache
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/pkg/errors"
@@ -25,6 +24,7 @@ type (
 		incDir       string
 		genDir       string
 		uuid         string
+		hashAlgo     string
 		parsed       bool
 	}
 	ParsedArgs struct {
@@ -45,7 +45,12 @@ type (
 )
 
 func ParseArgs(args []string) (ParsedArgs, error) {
-	p := parser{}
+	return ParseArgsWithHash(args, DefaultHashAlgo)
+}
+
+// ParseArgsWithHash parses args, computing the UUID with hashAlgo.
+func ParseArgsWithHash(args []string, hashAlgo string) (ParsedArgs, error) {
+	p := parser{hashAlgo: hashAlgo}
 	if !p.parsed {
 		if err := p.parse(args); err != nil {
 			return ParsedArgs{}, err
@@ -200,7 +205,10 @@ func (p *parser) computeUUID() error {
 		return errors.WithStack(err)
 	}
 
-	hash := sha256.New()
+	hash, err := newHash(p.hashAlgo)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	compilerModTime := ci.ModTime().Format(time.RFC3339)
 	hash.Write([]byte(p.compilerPath))
 	hash.Write([]byte(compilerModTime))
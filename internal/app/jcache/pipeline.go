@@ -0,0 +1,200 @@
+package jcache
+
+import (
+	"fmt"
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FsyncNone leaves flushing restored files to the OS.
+	FsyncNone = "none"
+	// FsyncFiles flushes every restored file before jcache exits.
+	FsyncFiles = "files"
+	// FsyncAll flushes restored files and the directories holding them.
+	FsyncAll = "all"
+)
+
+type (
+	restoreJob struct {
+		from string
+		to   string
+		cp   copyFunc
+	}
+
+	// pipeline restores files with a bounded pool of workers. All
+	// destination directories are created up front, so that workers only
+	// ever write files.
+	pipeline struct {
+		workers int
+		fsync   string
+		// phase is called with the name and the start of every phase
+		// once it finished.
+		phase func(name string, start time.Time)
+	}
+)
+
+func ParseFsyncPolicy(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", FsyncNone:
+		return FsyncNone, nil
+	case FsyncFiles, FsyncAll:
+		return strings.ToLower(s), nil
+	}
+	return FsyncNone, fmt.Errorf("unsupported fsync policy: %s", s)
+}
+
+// DefaultIOConcurrency is the number of files read or written at once
+// unless configured otherwise.
+func DefaultIOConcurrency() int {
+	return runtime.NumCPU()
+}
+
+// treeJobs plans restoring every regular file below srcPath to the same
+// relative path below dstPath.
+func treeJobs(srcPath, dstPath string, cp copyFunc) (jobs []restoreJob, err error) {
+	if dstPath == "" || DoesNotExist(srcPath) {
+		return nil, nil
+	}
+
+	err = godirwalk.Walk(srcPath, &godirwalk.Options{
+		FollowSymbolicLinks: true,
+		Unsorted:            true,
+		Callback: func(src string, de *godirwalk.Dirent) error {
+			if de.IsDir() {
+				return nil
+			}
+			if !de.IsRegular() {
+				return fmt.Errorf("file not regular: %s", src)
+			}
+
+			rel, err := filepath.Rel(srcPath, src)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			jobs = append(jobs, restoreJob{from: src, to: filepath.Join(dstPath, rel), cp: cp})
+			return nil
+		},
+	})
+	return jobs, err
+}
+
+func (p *pipeline) run(jobs []restoreJob) (nFiles int, nBytes int64, err error) {
+	start := time.Now()
+	dirs := make(map[string]bool)
+	for _, job := range jobs {
+		dirs[filepath.Dir(job.to)] = true
+	}
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	// parents first, so that MkdirAll finds them in place
+	sort.Strings(sortedDirs)
+	for _, dir := range sortedDirs {
+		if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+	}
+	p.phase("restore.mkdir", start)
+
+	start = time.Now()
+	nFiles, nBytes, err = p.copy(jobs)
+	p.phase("restore.copy", start)
+	if err != nil || p.fsync != FsyncAll {
+		return
+	}
+
+	start = time.Now()
+	for _, dir := range sortedDirs {
+		syncDir(dir)
+	}
+	p.phase("restore.fsync", start)
+	return
+}
+
+func (p *pipeline) copy(jobs []restoreJob) (nFiles int, nBytes int64, err error) {
+	workers := p.workers
+	if workers < 1 {
+		workers = DefaultIOConcurrency()
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	ch := make(chan restoreJob)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range ch {
+				w, err := p.restore(job)
+
+				mu.Lock()
+				if err == nil {
+					nFiles++
+					nBytes += w
+				} else if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		ch <- job
+	}
+	close(ch)
+	wg.Wait()
+
+	return nFiles, nBytes, firstErr
+}
+
+func (p *pipeline) restore(job restoreJob) (int64, error) {
+	w, err := job.cp(job.from, job.to)
+	if err != nil {
+		return w, errors.WithStack(err)
+	}
+	if p.fsync == FsyncNone || p.fsync == "" {
+		return w, nil
+	}
+	return w, errors.WithStack(syncFile(job.to))
+}
+
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// syncDir is best effort. Not every platform can flush directories.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dir.Sync()
+}
@@ -0,0 +1,37 @@
+//go:build linux && (386 || amd64 || arm || arm64 || riscv64 || s390x)
+
+package jcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE is _IOW(0x94, 9, int) with the generic ioctl encoding.
+const ficlone = 0x40049409
+
+// reflinkFile shares the extents of from with to (btrfs, xfs, ...).
+func reflinkFile(from, to string) (int64, error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	dst, err := createFile(to)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return 0, &os.PathError{Op: "ficlone", Path: to, Err: errno}
+	}
+	return stat.Size(), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || riscv64 || s390x)
+
+package jcache
+
+import (
+	"os"
+	"syscall"
+)
+
+func reflinkFile(from, to string) (int64, error) {
+	return 0, &os.PathError{Op: "reflink", Path: to, Err: syscall.EOPNOTSUPP}
+}
@@ -0,0 +1,92 @@
+package jcache
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Outcomes of an invocation as reported by Report.
+const (
+	// OutcomeHit served the outputs from the cache.
+	OutcomeHit = "hit"
+	// OutcomeMiss compiled and stored a new entry.
+	OutcomeMiss = "miss"
+	// OutcomeUncacheable compiled without storing an entry, e.g. because
+	// the cache is read-only or disabled.
+	OutcomeUncacheable = "uncacheable"
+	// OutcomeFallback ran the compiler directly after jcache failed.
+	OutcomeFallback = "fallback"
+)
+
+type (
+	// CompilerIdentity is what identifies the compiler in entry keys.
+	CompilerIdentity struct {
+		Path    string
+		ModTime time.Time
+	}
+
+	// Report describes a single invocation for build analytics.
+	// AppendReport writes it as one line of a JSON lines file.
+	Report struct {
+		Timestamp time.Time
+		Cwd       string
+		// Tag labels the reports of a build, e.g. a CI job.
+		Tag string
+		// Invocation is the id the invocation's log records carry.
+		Invocation string
+		Compiler   CompilerIdentity
+		Key        string
+		Outcome    string
+		// Reason explains misses, e.g. "sources modified", the use of the
+		// shared cache on hits and failures on fallbacks.
+		Reason        string
+		Sources       int
+		RestoredBytes int64
+		// RestoredFiles counts the files written by the restore,
+		// SkippedFiles those left untouched as they held their content.
+		RestoredFiles int64
+		SkippedFiles  int64
+		// Phases holds the time spent in lookup (the needCompilation
+		// check), compile, store and restore (the copy), in nanoseconds.
+		Phases map[string]time.Duration
+		// Exit is the exit code of the compiler.
+		Exit int
+	}
+)
+
+// NewReport starts the report of an invocation running right now.
+func NewReport(tag string) *Report {
+	r := &Report{
+		Timestamp: time.Now().UTC(),
+		Tag:       tag,
+		Phases:    make(map[string]time.Duration),
+	}
+	r.Cwd, _ = os.Getwd()
+	return r
+}
+
+// AppendReport appends r to the file at path as a single line. Lines are
+// written with a single write to a file opened for appending, so that
+// concurrent invocations do not interleave them.
+func AppendReport(path string, r *Report) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	return errors.WithStack(err)
+}
@@ -0,0 +1,340 @@
+package jcache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// RestoreAuto tries reflink, then copy_file_range, then copy.
+	RestoreAuto          = "auto"
+	RestoreCopy          = "copy"
+	RestoreReflink       = "reflink"
+	RestoreHardlink      = "hardlink"
+	RestoreCopyFileRange = "copy_file_range"
+
+	// MTimeNow leaves restored files with the time they were written.
+	MTimeNow = "now"
+	// MTimePreserve restores the mtime the compiler gave the file.
+	MTimePreserve = "preserve"
+	// MTimeSourceDateEpoch preserves mtimes, clamped to SOURCE_DATE_EPOCH.
+	MTimeSourceDateEpoch = "source_date_epoch"
+	// MTimeNewestSource sets the mtime of the newest source file.
+	MTimeNewestSource = "newest_source"
+)
+
+type (
+	restoreMethod struct {
+		name string
+		cp   copyFunc
+		// unsupported is set once the method failed, so that the
+		// remaining files skip straight to the next method.
+		unsupported int32
+	}
+
+	// restorer restores raw files using the first method of its chain
+	// the filesystem supports. Plain copying always ends the chain.
+	restorer struct {
+		chain []*restoreMethod
+		// known maps restore destinations to the manifest entry they
+		// receive.
+		known map[string]ManifestEntry
+		// skip leaves known destinations that already hold their content
+		// untouched. algo computed the digests of known.
+		skip bool
+		algo string
+		// mtime is the MTime* policy for known destinations. For
+		// MTimeSourceDateEpoch and MTimeNewestSource, mtimeAt holds the
+		// respective time.
+		mtime   string
+		mtimeAt time.Time
+		// verify checks the digest of every known destination written,
+		// in addition to its size, which is always checked. Either
+		// mismatching fails with ErrCorruptEntry.
+		verify  bool
+		written int64
+		skipped int64
+		// checked counts the known destinations found to hold their
+		// content.
+		checked int64
+	}
+)
+
+func ParseRestoreStrategy(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", RestoreAuto:
+		return RestoreAuto, nil
+	case RestoreCopy, RestoreReflink, RestoreHardlink, RestoreCopyFileRange:
+		return strings.ToLower(s), nil
+	}
+	return RestoreAuto, fmt.Errorf("unsupported restore strategy: %s", s)
+}
+
+func ParseMTimePolicy(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", MTimeNow:
+		return MTimeNow, nil
+	case MTimePreserve, MTimeSourceDateEpoch, MTimeNewestSource:
+		return strings.ToLower(s), nil
+	}
+	return MTimeNow, fmt.Errorf("unsupported mtime policy: %s", s)
+}
+
+func newRestorer(strategy string) *restorer {
+	var names []string
+	switch strategy {
+	case RestoreReflink:
+		names = []string{RestoreReflink}
+	case RestoreHardlink:
+		names = []string{RestoreHardlink}
+	case RestoreCopyFileRange:
+		names = []string{RestoreCopyFileRange}
+	case RestoreCopy:
+	default:
+		names = []string{RestoreReflink, RestoreCopyFileRange}
+	}
+	names = append(names, RestoreCopy)
+
+	r := &restorer{}
+	for _, name := range names {
+		r.chain = append(r.chain, &restoreMethod{name: name, cp: restoreMethods[name]})
+	}
+	return r
+}
+
+var restoreMethods = map[string]copyFunc{
+	RestoreCopy:     plainCopyFile,
+	RestoreReflink:  reflinkFile,
+	RestoreHardlink: hardlinkFile,
+	// io.Copy between two files uses copy_file_range(2) where the kernel
+	// supports it and falls back to a regular copy by itself.
+	RestoreCopyFileRange: copyFile,
+}
+
+func (r *restorer) copy(from, to string) (int64, error) {
+	last := len(r.chain) - 1
+	for i, m := range r.chain {
+		if i < last && atomic.LoadInt32(&m.unsupported) != 0 {
+			continue
+		}
+
+		n, err := m.cp(from, to)
+		if err != nil && i < last && unsupported(err) {
+			atomic.StoreInt32(&m.unsupported, 1)
+			continue
+		}
+		return n, err
+	}
+	panic("unreachable")
+}
+
+// unsupported reports whether err means that the filesystem or platform
+// does not support a restore method, as opposed to e.g. a full disk.
+func unsupported(err error) bool {
+	err = errors.Cause(err)
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	switch err {
+	case syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOSYS,
+		// ioctls the filesystem does not know, e.g. FICLONE on tmpfs
+		syscall.ENOTTY:
+		return true
+	}
+	return false
+}
+
+// index tells the restorer what destinations of manifest receive, so that
+// it can skip identical ones and restore their attributes.
+func (r *restorer) index(manifest []ManifestEntry, dstDirs map[string]string) {
+	r.known = make(map[string]ManifestEntry, len(manifest))
+	for _, me := range manifest {
+		if dst, ok := manifestDst(me, dstDirs); ok {
+			r.known[dst] = me
+		}
+	}
+}
+
+// manifestDst maps me to its restore destination. It reports false if
+// the tree of me is not restored or if its path is not local to the tree.
+func manifestDst(me ManifestEntry, dstDirs map[string]string) (string, bool) {
+	p, ok := localPath(me.Path)
+	if !ok {
+		return "", false
+	}
+	idx := strings.IndexByte(p, '/')
+	if idx < 0 {
+		return "", false
+	}
+	dstDir := dstDirs[p[:idx]]
+	if dstDir == "" {
+		return "", false
+	}
+	return filepath.Join(dstDir, filepath.FromSlash(p[idx+1:])), true
+}
+
+// wrap wraps cp so that it leaves identical destinations alone and
+// restores the attributes of the files it writes. Not touching identical
+// destinations keeps their mtime, which spares downstream tools from
+// redoing work.
+func (r *restorer) wrap(cp copyFunc) copyFunc {
+	return func(from, to string) (int64, error) {
+		me, ok := r.known[to]
+		if ok && r.skip && isIdentical(to, me, r.algo) {
+			atomic.AddInt64(&r.skipped, 1)
+			atomic.AddInt64(&r.checked, 1)
+			return 0, nil
+		}
+
+		n, err := cp(from, to)
+		if err != nil {
+			if ok && os.IsNotExist(errors.Cause(err)) {
+				return n, corruptEntry(from, "stored file missing")
+			}
+			return n, err
+		}
+		atomic.AddInt64(&r.written, 1)
+		if !ok {
+			return n, nil
+		}
+		if !r.check(to, me) {
+			return n, corruptEntry(from, "restored %s does not match the manifest", to)
+		}
+		atomic.AddInt64(&r.checked, 1)
+		return n, r.restoreAttrs(from, to, me)
+	}
+}
+
+// restoreAttrs applies the permission bits and the mtime of me to to.
+// Files hard linked to the cache are left alone; changing them would
+// change the cache.
+func (r *restorer) restoreAttrs(from, to string, me ManifestEntry) error {
+	if srcStat, err := os.Stat(from); err == nil {
+		if dstStat, err := os.Stat(to); err == nil && os.SameFile(srcStat, dstStat) {
+			return nil
+		}
+	}
+
+	if me.Mode != 0 {
+		if err := os.Chmod(to, me.Mode); err != nil {
+			return err
+		}
+	}
+	if mtime := r.mtimeOf(me); !mtime.IsZero() {
+		return os.Chtimes(to, mtime, mtime)
+	}
+	return nil
+}
+
+// mtimeOf returns the mtime to restore me with, or the zero time to keep
+// the time of writing.
+func (r *restorer) mtimeOf(me ManifestEntry) time.Time {
+	switch r.mtime {
+	case MTimePreserve:
+		return me.ModTime
+	case MTimeSourceDateEpoch:
+		if me.ModTime.IsZero() || me.ModTime.After(r.mtimeAt) {
+			return r.mtimeAt
+		}
+		return me.ModTime
+	case MTimeNewestSource:
+		return r.mtimeAt
+	}
+	return time.Time{}
+}
+
+// check compares the restored file at path to me, by digest only if
+// verifying. The size check is cheap and catches truncated entries.
+func (r *restorer) check(path string, me ManifestEntry) bool {
+	if r.verify {
+		return isIdentical(path, me, r.algo)
+	}
+	stat, err := os.Stat(path)
+	return err == nil && stat.Size() == me.Size
+}
+
+func isIdentical(path string, me ManifestEntry, algo string) bool {
+	stat, err := os.Stat(path)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() != me.Size {
+		return false
+	}
+	digest, err := HashFile(path, algo)
+	return err == nil && digest == me.Object
+}
+
+func (r *restorer) counts() (written, skipped int64) {
+	return atomic.LoadInt64(&r.written), atomic.LoadInt64(&r.skipped)
+}
+
+// missing returns the number of known destinations that were not found to
+// hold their content, e.g. because the entry lost the files.
+func (r *restorer) missing() int {
+	return len(r.known) - int(atomic.LoadInt64(&r.checked))
+}
+
+// fellBack lists the methods that turned out to be unsupported.
+func (r *restorer) fellBack() []string {
+	var names []string
+	for _, m := range r.chain {
+		if atomic.LoadInt32(&m.unsupported) != 0 {
+			names = append(names, m.name)
+		}
+	}
+	return names
+}
+
+// plainCopyFile copies through user space. Hiding the destination's
+// ReadFrom keeps io.Copy from using copy_file_range or sendfile.
+func plainCopyFile(from, to string) (int64, error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := createFile(to)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	return io.Copy(struct{ io.Writer }{dst}, src)
+}
+
+// hardlinkFile links to to from. The cached file is made read-only, so
+// that writes through the link cannot corrupt the cache.
+func hardlinkFile(from, to string) (int64, error) {
+	srcStat, err := os.Stat(from)
+	if err != nil {
+		return 0, err
+	}
+	if dstStat, err := os.Stat(to); err == nil && os.SameFile(srcStat, dstStat) {
+		return srcStat.Size(), nil
+	}
+
+	if srcStat.Mode().Perm()&0222 != 0 {
+		if err = os.Chmod(from, srcStat.Mode().Perm()&^0222); err != nil {
+			return 0, err
+		}
+	}
+	if err = os.Remove(to); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err = os.Link(from, to); err != nil {
+		return 0, err
+	}
+	return srcStat.Size(), nil
+}
@@ -0,0 +1,16 @@
+//go:build darwin || freebsd || netbsd
+
+package jcache
+
+import (
+	"os"
+	"syscall"
+)
+
+func sysStamp(s *fileStamp, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		s.Dev = uint64(st.Dev)
+		s.Ino = uint64(st.Ino)
+		s.ChangeTime = st.Ctimespec.Nano()
+	}
+}
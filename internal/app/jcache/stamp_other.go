@@ -0,0 +1,9 @@
+//go:build !(linux || openbsd || dragonfly || solaris || illumos || darwin || freebsd || netbsd)
+
+package jcache
+
+import "os"
+
+// sysStamp leaves device, inode and ctime zero where the platform does
+// not expose them. Stamps then rest on size and mtime alone.
+func sysStamp(s *fileStamp, fi os.FileInfo) {}
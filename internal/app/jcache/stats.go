@@ -0,0 +1,126 @@
+package jcache
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const statsLockTimeout = 2 * time.Second
+
+// Stats are cache-wide counters shared by all invocations using the
+// same basePath. Updating them is best-effort and never fails a build.
+type Stats struct {
+	Hits           int64
+	Misses         int64
+	TierHits       int64
+	RemoteErrors   int64
+	RemoteTimeouts int64
+	RemoteSkips    int64
+	// Phases sums up the time invocations spent in each phase, e.g.
+	// lookup, compile, store, restore and the steps of restoring.
+	Phases   map[string]time.Duration
+	ZeroedAt time.Time
+}
+
+func statsPath(basePath string) string {
+	return filepath.Join(basePath, "stats.json")
+}
+
+func LoadStats(basePath string) (*Stats, error) {
+	stats := &Stats{}
+	file, err := os.Open(statsPath(basePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	if err = NewDecoder(file).Decode(stats); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return stats, nil
+}
+
+func ZeroStats(basePath string) error {
+	return updateStats(basePath, func(s *Stats) {
+		*s = Stats{ZeroedAt: time.Now().UTC()}
+	})
+}
+
+func updateStats(basePath string, update func(*Stats)) error {
+	if err := os.MkdirAll(basePath, os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+
+	path := statsPath(basePath)
+	lock, err := acquireLock(path+".lock", statsLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	stats, err := LoadStats(basePath)
+	if err != nil {
+		// start over rather than being stuck with a broken file
+		stats = &Stats{}
+	}
+	update(stats)
+
+	tmp, err := ioutil.TempFile(basePath, ".stats-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = NewEncoder(tmp).Encode(stats)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
+
+// Usage summarizes the entries currently stored below basePath.
+// Entries predating storage-info.json are counted, but not sized.
+type Usage struct {
+	Entries     int
+	RawBytes    int64
+	StoredBytes int64
+}
+
+func (u Usage) CompressionRatio() float64 {
+	if u.StoredBytes == 0 {
+		return 1
+	}
+	return float64(u.RawBytes) / float64(u.StoredBytes)
+}
+
+func CacheUsage(basePath string) (Usage, error) {
+	usage := Usage{}
+	infos, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return usage, nil
+		}
+		return usage, errors.WithStack(err)
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() || !isEntryKey(info.Name()) {
+			continue
+		}
+		usage.Entries++
+
+		si, err := UnmarshalStorageInfo(filepath.Join(basePath, info.Name(), "storage-info.json"))
+		if err != nil {
+			continue
+		}
+		usage.RawBytes += si.RawBytes
+		usage.StoredBytes += si.StoredBytes
+	}
+	return usage, nil
+}
@@ -0,0 +1,278 @@
+package jcache
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tierLockTimeout = 30 * time.Second
+
+type (
+	TierMode int
+
+	// Tier is a cache location consulted after the local cache at basePath
+	// missed. Entries use the same on-disk layout as the local cache, but
+	// packed entries consist of their archive and storage-info.json only.
+	Tier interface {
+		Name() string
+		Mode() TierMode
+		// Fetch copies the entry for key into dstPath. It reports false if
+		// the tier does not hold a complete entry for key.
+		Fetch(key, dstPath string) (bool, error)
+		// Store publishes the entry at srcPath under key.
+		Store(key, srcPath string) error
+	}
+
+	dirTier struct {
+		path  string
+		mode  TierMode
+		umask os.FileMode
+		gid   int
+	}
+)
+
+const (
+	TierReadOnly TierMode = iota
+	TierReadWrite
+	// TierWriteOnly tiers are populated but never consulted.
+	TierWriteOnly
+)
+
+func (m TierMode) String() string {
+	switch m {
+	case TierReadOnly:
+		return "ro"
+	case TierReadWrite:
+		return "rw"
+	case TierWriteOnly:
+		return "wo"
+	}
+	return fmt.Sprintf("TierMode(%d)", int(m))
+}
+
+func (m TierMode) CanRead() bool {
+	return m == TierReadOnly || m == TierReadWrite
+}
+
+func (m TierMode) CanWrite() bool {
+	return m == TierReadWrite || m == TierWriteOnly
+}
+
+func ParseTierMode(s string) (TierMode, error) {
+	switch strings.ToLower(s) {
+	case "", "ro", "read-only", "readonly":
+		return TierReadOnly, nil
+	case "rw", "read-write", "readwrite":
+		return TierReadWrite, nil
+	case "wo", "write-only", "writeonly":
+		return TierWriteOnly, nil
+	}
+	return TierReadOnly, fmt.Errorf("invalid tier mode: %s", s)
+}
+
+// NewDirTier returns a Tier backed by a (possibly shared) directory.
+// Files published to a writable tier get their permission bits masked
+// by umask and, if group is not empty, are handed over to that group.
+func NewDirTier(path string, mode TierMode, umask os.FileMode, group string) (Tier, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	gid := -1
+	if group != "" {
+		gid, err = lookupGid(group)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return &dirTier{
+		path:  abs,
+		mode:  mode,
+		umask: umask,
+		gid:   gid,
+	}, nil
+}
+
+func lookupGid(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+func (t *dirTier) Name() string {
+	return t.path
+}
+
+func (t *dirTier) Mode() TierMode {
+	return t.mode
+}
+
+func (t *dirTier) Fetch(key, dstPath string) (bool, error) {
+	if !t.mode.CanRead() {
+		return false, nil
+	}
+
+	srcPath := filepath.Join(t.path, key)
+	fetch := func() error {
+		_, err := copyEntry(srcPath, dstPath)
+		return err
+	}
+	if anyNotExists(srcPath,
+		filepath.Join(srcPath, "source-info.json"),
+		filepath.Join(srcPath, "compiler-info.json")) {
+		if anyNotExists(filepath.Join(srcPath, packFileName), filepath.Join(srcPath, "storage-info.json")) {
+			return false, nil
+		}
+		fetch = func() error {
+			if err := copyPack(srcPath, dstPath); err != nil {
+				return err
+			}
+			return unpackMetadata(dstPath)
+		}
+	}
+
+	if err := os.RemoveAll(dstPath); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	// Store replaces entries by renaming a new directory in. If the
+	// directory at srcPath is the same before and after copying, all
+	// files were copied from the same entry.
+	before, err := os.Stat(srcPath)
+	if err != nil {
+		return false, nil
+	}
+	err = fetch()
+	if after, sErr := os.Stat(srcPath); sErr != nil || !os.SameFile(before, after) {
+		// replaced while copying; the copy may mix both entries
+		os.RemoveAll(dstPath)
+		return false, nil
+	}
+	if err != nil {
+		// never leave a partial entry behind
+		os.RemoveAll(dstPath)
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (t *dirTier) Store(key, srcPath string) error {
+	if !t.mode.CanWrite() {
+		return fmt.Errorf("tier %s is read-only", t.path)
+	}
+
+	if err := os.MkdirAll(t.path, t.dirPerm()); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// stage the entry next to its final location, so that publishing it
+	// is a single rename and readers never observe a partial entry.
+	stagingPath := filepath.Join(t.path, ".staging")
+	if err := os.MkdirAll(stagingPath, t.dirPerm()); err != nil {
+		return errors.WithStack(err)
+	}
+	// fails unless we created it, which is fine
+	t.applyPerm(stagingPath, true)
+	sweepScratch(stagingPath)
+
+	tmpPath := filepath.Join(stagingPath, uuid.New().String())
+	defer os.RemoveAll(tmpPath)
+
+	objects, err := stageEntry(srcPath, tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := t.applyPerms(tmpPath); err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := t.applyPerm(filepath.Dir(object), true); err != nil {
+			return err
+		}
+		if err := t.applyPerm(object, false); err != nil {
+			return err
+		}
+	}
+
+	lock, err := acquireLock(filepath.Join(t.path, key+".lock"), tierLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// Move the old entry aside rather than removing it in place, so that
+	// the entry is replaced by renames only. Removing it takes a while,
+	// during which readers would see it partially.
+	dstPath := filepath.Join(t.path, key)
+	oldPath := filepath.Join(stagingPath, "old-"+uuid.New().String())
+	if err := os.Rename(dstPath, oldPath); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(oldPath)
+
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Rename(oldPath, dstPath)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// stageEntry copies the entry at srcPath to dstPath for publishing. Packed
+// entries are published as copyPack transfers them.
+func stageEntry(srcPath, dstPath string) (objects []string, err error) {
+	si, err := UnmarshalStorageInfo(filepath.Join(srcPath, "storage-info.json"))
+	if err != nil || si.Layout != LayoutPacked {
+		return copyEntry(srcPath, dstPath)
+	}
+	return nil, copyPack(srcPath, dstPath)
+}
+
+func (t *dirTier) dirPerm() os.FileMode {
+	return os.ModePerm &^ t.umask
+}
+
+func (t *dirTier) filePerm() os.FileMode {
+	return 0666 &^ t.umask
+}
+
+func (t *dirTier) applyPerms(root string) error {
+	return godirwalk.Walk(root, &godirwalk.Options{
+		Unsorted: true,
+		Callback: func(path string, de *godirwalk.Dirent) error {
+			return t.applyPerm(path, de.IsDir())
+		},
+	})
+}
+
+func (t *dirTier) applyPerm(path string, isDir bool) error {
+	perm := t.filePerm()
+	if isDir {
+		perm = t.dirPerm()
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return errors.WithStack(err)
+	}
+	if t.gid >= 0 {
+		if err := os.Lchown(path, -1, t.gid); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
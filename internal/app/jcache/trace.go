@@ -0,0 +1,354 @@
+package jcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTraceTimeout = 2 * time.Second
+	tracesPath          = "/v1/traces"
+
+	// OTLP span kind and status codes
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+type (
+	// TraceConfig configures the export of spans to an OpenTelemetry
+	// collector over OTLP/HTTP. Tracing is off unless Endpoint is set.
+	TraceConfig struct {
+		// Endpoint is the URL spans are posted to, e.g.
+		// http://localhost:4318/v1/traces.
+		Endpoint string
+		Headers  map[string]string
+		// Traceparent is a W3C trace context header. The spans of the
+		// invocation become children of the span it names.
+		Traceparent string
+		ServiceName string
+		Version     string
+		Timeout     time.Duration
+	}
+
+	// Tracer records the spans of an invocation and exports them in one
+	// request. A nil *Tracer records nothing, as does one whose parent
+	// is not sampled.
+	Tracer struct {
+		cfg      TraceConfig
+		client   *http.Client
+		traceID  [16]byte
+		parentID [8]byte
+		sampled  bool
+
+		mu    sync.Mutex
+		spans []*Span
+	}
+
+	// Span is a timed operation. The methods of a nil *Span do nothing.
+	Span struct {
+		tracer   *Tracer
+		name     string
+		spanID   [8]byte
+		parentID [8]byte
+		start    time.Time
+		end      time.Time
+		attrs    map[string]interface{}
+		err      error
+	}
+
+	// The OTLP/HTTP JSON encoding of spans. IDs are hex, times are
+	// decimal strings of Unix nanoseconds.
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []otlpAttr `json:"attributes,omitempty"`
+		Status            otlpStatus `json:"status"`
+	}
+	otlpAttr struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// TraceConfigFromEnv reads the standard OpenTelemetry variables
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_EXPORTER_OTLP_ENDPOINT (to which
+// /v1/traces is appended), OTEL_EXPORTER_OTLP_HEADERS,
+// OTEL_EXPORTER_OTLP_TIMEOUT (milliseconds) and OTEL_SERVICE_NAME as well
+// as TRACEPARENT.
+func TraceConfigFromEnv() TraceConfig {
+	cfg := TraceConfig{
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		Headers:     make(map[string]string),
+		Traceparent: os.Getenv("TRACEPARENT"),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+	}
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); cfg.Endpoint == "" && base != "" {
+		cfg.Endpoint = strings.TrimSuffix(base, "/") + tracesPath
+	}
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if kv := strings.SplitN(header, "=", 2); len(kv) == 2 {
+			cfg.Headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if ms, err := strconv.Atoi(os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT")); err == nil && ms > 0 {
+		cfg.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	return cfg
+}
+
+// ParseTraceparent parses a W3C trace context traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceparent(s string) (traceID [16]byte, parentID [8]byte, sampled bool, err error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, false, fmt.Errorf("malformed traceparent: %s", s)
+	}
+
+	var flags [1]byte
+	for _, field := range []struct {
+		dst []byte
+		hex string
+	}{{traceID[:], parts[1]}, {parentID[:], parts[2]}, {flags[:], parts[3]}} {
+		if strings.ToLower(field.hex) != field.hex {
+			return traceID, parentID, false, fmt.Errorf("malformed traceparent: %s", s)
+		}
+		if _, err = hex.Decode(field.dst, []byte(field.hex)); err != nil {
+			return traceID, parentID, false, fmt.Errorf("malformed traceparent: %s", s)
+		}
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, fmt.Errorf("invalid traceparent: %s", s)
+	}
+	return traceID, parentID, flags[0]&1 == 1, nil
+}
+
+// NewTracer returns a Tracer exporting to cfg.Endpoint, or nil if cfg has
+// no endpoint. An invalid cfg.Traceparent starts a new trace.
+func NewTracer(cfg TraceConfig) *Tracer {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "jcache"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTraceTimeout
+	}
+
+	t := &Tracer{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		sampled: true,
+	}
+	var err error
+	if t.traceID, t.parentID, t.sampled, err = ParseTraceparent(cfg.Traceparent); err != nil {
+		t.traceID, t.parentID, t.sampled = randomTraceID(), [8]byte{}, true
+	}
+	return t
+}
+
+func randomTraceID() (id [16]byte) {
+	rand.Read(id[:])
+	return
+}
+
+func randomSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return
+}
+
+// Start starts a span named name. Spans without a parent are children of
+// the span named by the traceparent, if any.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	return t.startAt(name, parent, time.Now())
+}
+
+func (t *Tracer) startAt(name string, parent *Span, start time.Time) *Span {
+	if t == nil || !t.sampled {
+		return nil
+	}
+
+	s := &Span{
+		tracer:   t,
+		name:     name,
+		spanID:   randomSpanID(),
+		parentID: t.parentID,
+		start:    start,
+		attrs:    make(map[string]interface{}),
+	}
+	if parent != nil {
+		s.parentID = parent.spanID
+	}
+	return s
+}
+
+// SetAttr sets the attribute key. value is a string, bool, integer or
+// float; anything else is recorded as its string form.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed by err, unless err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err
+}
+
+// End ends the span and queues it for Export.
+func (s *Span) End() {
+	s.endAt(time.Now())
+}
+
+func (s *Span) endAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.end = end
+
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// Export posts all ended spans to the collector in a single request.
+func (t *Tracer) Export() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "jcache", Version: t.cfg.Version}}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, t.encodeSpan(s))
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttr{
+			encodeAttr("service.name", t.cfg.ServiceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting %d spans to %s: %s", len(spans), t.cfg.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (t *Tracer) encodeSpan(s *Span) otlpSpan {
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(t.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		span.Attributes = append(span.Attributes, encodeAttr(k, s.attrs[k]))
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: statusCodeError, Message: s.err.Error()}
+	}
+	return span
+}
+
+func encodeAttr(key string, value interface{}) otlpAttr {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(int64(value), 10)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttr{Key: key, Value: v}
+}
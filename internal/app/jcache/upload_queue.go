@@ -0,0 +1,308 @@
+package jcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultUploadQueueSize = 256
+	maxUploadAttempts      = 5
+	uploadRetryBackoff     = 30 * time.Second
+	uploadFlushTimeout     = 10 * time.Minute
+)
+
+type (
+	// uploadQueue is a spool directory of entries waiting to be published
+	// to a read-write tier. Each pending upload is one small JSON record,
+	// so that any jcache process can pick up where another one left off,
+	// and a snapshot of the entry taken when it was queued. Uploading the
+	// snapshot keeps later writes to the entry, e.g. a recompilation,
+	// from being published half done. Snapshots hard link the files of
+	// the entry, so queueing costs no copy.
+	uploadQueue struct {
+		path string
+		size int
+	}
+	PendingUpload struct {
+		Key        string
+		Tier       string
+		EnqueuedAt time.Time
+		// Snapshot names the snapshot of the entry taken when it was queued.
+		Snapshot    string
+		Attempts    int
+		NextAttempt time.Time
+		LastError   string
+	}
+)
+
+func newUploadQueue(basePath string, size int) *uploadQueue {
+	if size <= 0 {
+		size = DefaultUploadQueueSize
+	}
+	return &uploadQueue{
+		path: filepath.Join(basePath, "uploads"),
+		size: size,
+	}
+}
+
+func (q *uploadQueue) recordPath(key, tier string) string {
+	tierSum := sha256.Sum256([]byte(tier))
+	return filepath.Join(q.path, key+"@"+hex.EncodeToString(tierSum[:4])+".json")
+}
+
+// snapshotPath is the copy of the entry that up uploads. Objects it refers to
+// are kept next to it, in the snapshot's own object store.
+func (q *uploadQueue) snapshotPath(up *PendingUpload) string {
+	return filepath.Join(q.path, "snapshots", up.Snapshot, up.Key)
+}
+
+// push enqueues the entry at entryPath for upload to tier under key. If
+// the queue is full, the uploads queued first are dropped to make room.
+func (q *uploadQueue) push(key, tier, entryPath string) (dropped []PendingUpload, err error) {
+	if err = os.MkdirAll(q.path, os.ModePerm); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	pending, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(pending, func(i, k int) bool {
+		return pending[i].EnqueuedAt.Before(pending[k].EnqueuedAt)
+	})
+	for len(pending) >= q.size {
+		dropped = append(dropped, pending[0])
+		q.remove(&pending[0])
+		pending = pending[1:]
+	}
+
+	now := time.Now().UTC()
+	up := &PendingUpload{
+		Key:         key,
+		Tier:        tier,
+		EnqueuedAt:  now,
+		Snapshot:    uuid.New().String(),
+		NextAttempt: now,
+	}
+	if err = q.snapshot(up, entryPath); err != nil {
+		return dropped, err
+	}
+	// a snapshot replaced by this one is left to the next drain, which
+	// may be uploading it right now
+	return dropped, q.write(up)
+}
+
+// snapshot links the entry at entryPath to the snapshot of up.
+func (q *uploadQueue) snapshot(up *PendingUpload, entryPath string) error {
+	// stage the links, so that a drain never uploads a partial snapshot
+	stagingPath := filepath.Join(q.path, ".staging")
+	sweepScratch(stagingPath)
+	tmpPath := filepath.Join(stagingPath, up.Snapshot)
+	defer os.RemoveAll(tmpPath)
+	if err := os.MkdirAll(tmpPath, os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := linkEntry(entryPath, filepath.Join(tmpPath, up.Key)); err != nil {
+		return err
+	}
+
+	dst := filepath.Dir(q.snapshotPath(up))
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpPath, dst))
+}
+
+// sweepSnapshots removes the snapshots no pending upload refers to. It
+// spares recent ones, which may belong to uploads being queued.
+func (q *uploadQueue) sweepSnapshots() {
+	pending, err := q.list()
+	if err != nil {
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, up := range pending {
+		referenced[up.Snapshot] = true
+	}
+
+	dir := filepath.Join(q.path, "snapshots")
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if !referenced[info.Name()] && time.Since(info.ModTime()) > scratchStaleAfter {
+			os.RemoveAll(filepath.Join(dir, info.Name()))
+		}
+	}
+}
+
+// current reports whether the record of up on disk is still up's, rather
+// than one of a later push of the same entry.
+func (q *uploadQueue) current(up *PendingUpload) bool {
+	file, err := os.Open(q.recordPath(up.Key, up.Tier))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	cur := PendingUpload{}
+	return NewDecoder(file).Decode(&cur) == nil && cur.Snapshot == up.Snapshot
+}
+
+func (q *uploadQueue) write(up *PendingUpload) error {
+	// write to a temporary file first; a concurrent drain must never
+	// read a half-written record.
+	tmp, err := ioutil.TempFile(q.path, ".tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = NewEncoder(tmp).Encode(up)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), q.recordPath(up.Key, up.Tier)))
+}
+
+// remove dequeues up, unless a later push of the same entry replaced it.
+func (q *uploadQueue) remove(up *PendingUpload) error {
+	if !q.current(up) {
+		return nil
+	}
+	if err := os.Remove(q.recordPath(up.Key, up.Tier)); err != nil {
+		return errors.WithStack(err)
+	}
+	if up.Snapshot == "" {
+		return nil
+	}
+	return errors.WithStack(os.RemoveAll(filepath.Dir(q.snapshotPath(up))))
+}
+
+// list returns all pending uploads, due first.
+func (q *uploadQueue) list() ([]PendingUpload, error) {
+	infos, err := ioutil.ReadDir(q.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var pending []PendingUpload
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+
+		up := PendingUpload{}
+		file, err := os.Open(filepath.Join(q.path, info.Name()))
+		if err != nil {
+			continue
+		}
+		err = NewDecoder(file).Decode(&up)
+		file.Close()
+		if err != nil {
+			continue
+		}
+		pending = append(pending, up)
+	}
+
+	sort.Slice(pending, func(i, k int) bool {
+		return pending[i].NextAttempt.Before(pending[k].NextAttempt)
+	})
+	return pending, nil
+}
+
+// PendingUploads returns the uploads currently queued below basePath.
+func PendingUploads(basePath string) ([]PendingUpload, error) {
+	return newUploadQueue(basePath, 0).list()
+}
+
+// DrainUploads publishes queued entries to their tiers. A regular drain
+// only attempts uploads that are due and gives up immediately if another
+// process is already draining. With flush set, it waits for concurrent
+// drains and attempts every pending upload regardless of its backoff.
+// Failed uploads are retried with exponential backoff up to
+// maxUploadAttempts times before they are dropped.
+func DrainUploads(basePath string, tiers []Tier, logger Logger, flush bool) (remaining int, err error) {
+	q := newUploadQueue(basePath, 0)
+	if err = os.MkdirAll(q.path, os.ModePerm); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	timeout := time.Duration(0)
+	if flush {
+		timeout = uploadFlushTimeout
+	}
+	lock, err := acquireLock(filepath.Join(q.path, "drain.lock"), timeout)
+	if err != nil {
+		if _, ok := errors.Cause(err).(ErrLockTimeout); ok && !flush {
+			// someone else is on it
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer lock.Release()
+
+	byName := make(map[string]Tier)
+	for _, tier := range tiers {
+		byName[tier.Name()] = tier
+	}
+
+	pending, err := q.list()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for i := range pending {
+		up := &pending[i]
+		if !flush && up.NextAttempt.After(now) {
+			remaining++
+			continue
+		}
+
+		tier, ok := byName[up.Tier]
+		entryPath := q.snapshotPath(up)
+		if !ok || up.Snapshot == "" || DoesNotExist(entryPath) {
+			logger.Info("dropping upload of %s to %s - tier or snapshot gone", up.Key, up.Tier)
+			q.remove(up)
+			continue
+		}
+
+		start := time.Now()
+		if storeErr := tier.Store(up.Key, entryPath); storeErr != nil {
+			up.Attempts++
+			up.LastError = storeErr.Error()
+			if up.Attempts >= maxUploadAttempts {
+				logger.Error("giving up upload of %s to %s after %d attempts - %+v",
+					up.Key, up.Tier, up.Attempts, storeErr)
+				q.remove(up)
+				continue
+			}
+
+			up.NextAttempt = time.Now().Add(uploadRetryBackoff << uint(up.Attempts-1)).UTC()
+			logger.Warn("failed to upload %s to %s (attempt %d) - %+v",
+				up.Key, up.Tier, up.Attempts, storeErr)
+			if q.current(up) {
+				q.write(up)
+			}
+			remaining++
+			continue
+		}
+
+		logger.Info("uploaded %s to %s in %v", up.Key, up.Tier, time.Since(start))
+		q.remove(up)
+	}
+
+	q.sweepSnapshots()
+	return remaining, nil
+}
@@ -3,21 +3,91 @@ package jcache
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"time"
 )
 
+// scratchStaleAfter is the age after which scratch directories are
+// considered abandoned by a process that exited while a timed out request
+// was still writing them.
+const scratchStaleAfter = time.Hour
+
 func Sha256File(path string) (string, error) {
-	bytes, err := ioutil.ReadFile(path)
+	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
+	defer file.Close()
 
-	sum256 := sha256.Sum256(bytes)
-	return hex.EncodeToString(sum256[:]), nil
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func DoesNotExist(path string) bool {
 	_, err := os.Stat(path)
 	return os.IsNotExist(err)
 }
+
+// sweepScratch removes the abandoned scratch directories below dir.
+func sweepScratch(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if time.Since(info.ModTime()) > scratchStaleAfter {
+			os.RemoveAll(filepath.Join(dir, info.Name()))
+		}
+	}
+}
+
+func anyNotExists(paths ...string) bool {
+	for _, path := range paths {
+		if DoesNotExist(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEntryKey reports whether name looks like a cache entry directory.
+// Keys are hex encoded digests of 128 to 512 bits.
+func isEntryKey(name string) bool {
+	if len(name) < 32 || len(name) > 128 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// isDigest reports whether s looks like a digest as computed by newHash:
+// lower case hex of 128 to 512 bits.
+func isDigest(s string) bool {
+	if len(s) < 32 || len(s) > 128 || len(s)%2 != 0 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// localPath cleans the slash separated path p and reports whether it names
+// something below the directory it is relative to. Paths taken from
+// entries must pass it; entries may come from shared caches and archives.
+func localPath(p string) (string, bool) {
+	clean := path.Clean(p)
+	if path.IsAbs(p) || clean == "." || !filepath.IsLocal(filepath.FromSlash(clean)) {
+		return "", false
+	}
+	return clean, true
+}
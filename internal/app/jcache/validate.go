@@ -0,0 +1,116 @@
+package jcache
+
+import (
+	"os"
+	"time"
+)
+
+// racyWindow covers the timestamp granularity of common filesystems,
+// down to the 2 seconds of FAT. A file modified within this window of
+// its state being recorded may have changed without its mtime changing.
+const racyWindow = 2 * time.Second
+
+func newFileInfo(path string, stat os.FileInfo, digest Digest) FileInfo {
+	stamp := newFileStamp(stat)
+	info := FileInfo{
+		Path:    path,
+		ModTime: stat.ModTime().UTC(),
+		Size:    stat.Size(),
+		Digest:  digest,
+	}
+	if stamp.ChangeTime != 0 {
+		info.ChangeTime = time.Unix(0, stamp.ChangeTime).UTC()
+	}
+	return info
+}
+
+// staleReason tells why the state of a file recorded as info at
+// recordedAt cannot be trusted without verifying its digest. It returns
+// "" if the stat of the file matches the record.
+func staleReason(info FileInfo, stat os.FileInfo, recordedAt time.Time) string {
+	current := newFileInfo(info.Path, stat, Digest{})
+	switch {
+	case !current.ModTime.Equal(info.ModTime):
+		return "modified time mismatch"
+	case current.Size != info.Size:
+		return "size mismatch"
+	case !info.ChangeTime.IsZero() && !current.ChangeTime.Equal(info.ChangeTime):
+		return "change time mismatch"
+	case isRacy(info.ModTime, recordedAt):
+		return "racy modified time"
+	}
+	return ""
+}
+
+// isRacy reports whether a file last modified at modTime may have been
+// modified again unnoticed after its state was recorded at recordedAt.
+func isRacy(modTime, recordedAt time.Time) bool {
+	return !modTime.Before(recordedAt.Add(-racyWindow))
+}
+
+const (
+	// VerdictUnchanged means the stat of the file matches its record.
+	VerdictUnchanged = "unchanged"
+	// VerdictTouched means the stat changed, but the content did not.
+	VerdictTouched  = "touched"
+	VerdictModified = "modified"
+	VerdictMissing  = "missing"
+)
+
+// FileVerdict is the outcome of validating one recorded source. Reason
+// tells why the digest of the file had to be verified, if it had to be.
+// Info is the record refreshed to the current state of the file.
+type FileVerdict struct {
+	Path    string
+	Verdict string
+	Reason  string
+	Info    FileInfo
+}
+
+// validateSources checks every file of infoSlice, recorded at recordedAt,
+// against its current state. Files whose stat does not match their record
+// are verified by digest, using the algorithm they were recorded with.
+func validateSources(infoSlice []FileInfo, recordedAt time.Time, fp *fingerprinter) []FileVerdict {
+	verdicts := make([]FileVerdict, len(infoSlice))
+	var verify []int
+	for i, info := range infoSlice {
+		verdicts[i] = FileVerdict{Path: info.Path, Verdict: VerdictUnchanged, Info: info}
+
+		stat, err := os.Stat(info.Path)
+		if err != nil {
+			verdicts[i].Verdict = VerdictMissing
+			verdicts[i].Reason = err.Error()
+			continue
+		}
+		if verdicts[i].Reason = staleReason(info, stat, recordedAt); verdicts[i].Reason != "" {
+			verify = append(verify, i)
+		}
+	}
+
+	paths := make([]string, len(verify))
+	algos := make([]string, len(verify))
+	for k, i := range verify {
+		paths[k] = infoSlice[i].Path
+		algos[k] = infoSlice[i].Digest.Algo
+	}
+	digests, stats, errs := fp.fingerprint(paths, algos)
+
+	for k, i := range verify {
+		v := &verdicts[i]
+		switch {
+		case errs[k] != nil:
+			// vanished or unreadable since the stat above
+			v.Verdict = VerdictMissing
+			v.Reason = errs[k].Error()
+		case digests[k] != v.Info.Digest.Value:
+			v.Verdict = VerdictModified
+		default:
+			if !stats[k].ModTime().Equal(v.Info.ModTime) {
+				v.Verdict = VerdictTouched
+			}
+			v.Info = newFileInfo(v.Path, stats[k], Digest{Algo: algos[k], Value: digests[k]})
+		}
+	}
+
+	return verdicts
+}
@@ -0,0 +1,242 @@
+package jcache
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const quarantineDirName = "quarantine"
+
+type (
+	// ErrCorruptEntry reports an entry whose metadata does not parse or
+	// whose stored files do not match its manifest. Path is the entry or
+	// the stored file found to be corrupt.
+	ErrCorruptEntry struct {
+		error
+		Path string
+	}
+
+	// Verification summarizes a Verify run.
+	Verification struct {
+		Entries int
+		// Corrupt lists the entries moved to the quarantine.
+		Corrupt []ErrCorruptEntry
+		// CorruptObjects counts the objects moved to the quarantine.
+		CorruptObjects int
+	}
+)
+
+func corruptEntry(path, format string, args ...interface{}) error {
+	return ErrCorruptEntry{
+		error: fmt.Errorf(format, args...),
+		Path:  path,
+	}
+}
+
+// IsCorruptEntry reports whether err or its cause is an ErrCorruptEntry.
+func IsCorruptEntry(err error) bool {
+	_, ok := errors.Cause(err).(ErrCorruptEntry)
+	return ok
+}
+
+// checkContent reads r to its end and compares its size and algo digest
+// with those me records.
+func checkContent(r io.Reader, me ManifestEntry, algo string) error {
+	hash, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return err
+	}
+	if n != me.Size {
+		return fmt.Errorf("%s: size %d, manifest says %d", me.Path, n, me.Size)
+	}
+	if digest := hex.EncodeToString(hash.Sum(nil)); digest != me.Object {
+		return fmt.Errorf("%s: digest %s, manifest says %s", me.Path, digest, me.Object)
+	}
+	return nil
+}
+
+// checkStoredFile checks the file at path, stored with compression,
+// against me.
+func checkStoredFile(path, compression string, me ManifestEntry, algo string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if compression != CompressionGzip {
+		return checkContent(file, me, algo)
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return checkContent(zr, me, algo)
+}
+
+// verifyEntry parses all metadata of the entry at entryPath and checks
+// every stored file against the manifest. objects remembers the verdicts
+// on the objects of the entry's object store, which are shared between
+// entries.
+func verifyEntry(entryPath string, objects map[string]error) error {
+	if path := entryFormatPath(entryPath); !DoesNotExist(path) {
+		if _, err := UnmarshalEntryFormat(path); err != nil {
+			return corruptEntry(entryPath, "format.json: %v", err)
+		}
+	}
+	if path := entryInfoPath(entryPath); !DoesNotExist(path) {
+		if _, err := UnmarshalEntryInfo(path); err != nil {
+			return corruptEntry(entryPath, "%s: %v", entryInfoFileName, err)
+		}
+	}
+	if _, err := UnmarshalFileInfoSlice(filepath.Join(entryPath, "source-info.json")); err != nil {
+		return corruptEntry(entryPath, "source-info.json: %v", err)
+	}
+	if _, err := UnmarshalExecInfo(filepath.Join(entryPath, "compiler-info.json")); err != nil {
+		return corruptEntry(entryPath, "compiler-info.json: %v", err)
+	}
+
+	si := &StorageInfo{Layout: LayoutTree, Compression: CompressionNone}
+	if path := filepath.Join(entryPath, "storage-info.json"); !DoesNotExist(path) {
+		var err error
+		if si, err = UnmarshalStorageInfo(path); err != nil {
+			return corruptEntry(entryPath, "storage-info.json: %v", err)
+		}
+		if _, err = ParseLayout(si.Layout); err != nil {
+			return corruptEntry(entryPath, "storage-info.json: %v", err)
+		}
+		if _, err = ParseCompression(si.Compression); err != nil {
+			return corruptEntry(entryPath, "storage-info.json: %v", err)
+		}
+		if _, err = newHash(si.HashAlgo); err != nil {
+			return corruptEntry(entryPath, "storage-info.json: %v", err)
+		}
+	}
+
+	manifestPath := filepath.Join(entryPath, "manifest.json")
+	if si.Layout == LayoutTree && DoesNotExist(manifestPath) {
+		// predates manifests. nothing to check the trees against
+		return nil
+	}
+	manifest, err := loadManifest(manifestPath)
+	if err != nil {
+		return corruptEntry(entryPath, "manifest.json: %v", err)
+	}
+
+	switch si.Layout {
+	case LayoutPacked:
+		return verifyPack(entryPath, manifest, si.HashAlgo)
+	case LayoutObjects:
+		for _, me := range manifest {
+			path := objectPath(objectsDir(entryPath), me.Object, si.Compression)
+			objErr, ok := objects[path]
+			if !ok {
+				objErr = checkStoredFile(path, si.Compression, me, si.HashAlgo)
+				objects[path] = objErr
+			}
+			if objErr != nil {
+				return corruptEntry(entryPath, "object %s: %v", me.Object, objErr)
+			}
+		}
+	default:
+		for _, me := range manifest {
+			path := filepath.Join(entryPath, filepath.FromSlash(me.Path))
+			if err = checkStoredFile(path, si.Compression, me, si.HashAlgo); err != nil {
+				return corruptEntry(entryPath, "%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyPack checks the members of the entry's archive against manifest.
+// Reading a member to its end also checks its CRC.
+func verifyPack(entryPath string, manifest []ManifestEntry, algo string) error {
+	zr, err := zip.OpenReader(filepath.Join(entryPath, packFileName))
+	if err != nil {
+		return corruptEntry(entryPath, "%s: %v", packFileName, err)
+	}
+	defer zr.Close()
+
+	members := make(map[string]*zip.File, len(zr.File))
+	for _, zf := range zr.File {
+		if clean, ok := localPath(zf.Name); !ok || clean != zf.Name {
+			return corruptEntry(entryPath, "%s: member %q escapes the entry", packFileName, zf.Name)
+		}
+		members[zf.Name] = zf
+	}
+	for _, me := range manifest {
+		zf, ok := members[me.Path]
+		if !ok {
+			return corruptEntry(entryPath, "%s: missing from %s", me.Path, packFileName)
+		}
+		src, err := zf.Open()
+		if err == nil {
+			err = checkContent(src, me, algo)
+			src.Close()
+		}
+		if err != nil {
+			return corruptEntry(entryPath, "%v", err)
+		}
+	}
+	return nil
+}
+
+// quarantine moves the entry or object at the basePath relative path rel
+// to the quarantine, replacing whatever an earlier run put there.
+func quarantine(basePath, rel string) error {
+	dst := filepath.Join(basePath, quarantineDirName, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(filepath.Join(basePath, rel), dst))
+}
+
+// Verify checks all complete entries below basePath and moves the corrupt
+// ones, along with the corrupt objects, to the quarantine.
+func Verify(basePath string) (v Verification, err error) {
+	keys, err := completeEntries(basePath)
+	if err != nil {
+		return v, err
+	}
+
+	objects := make(map[string]error)
+	for _, key := range keys {
+		v.Entries++
+		if err := verifyEntry(filepath.Join(basePath, key), objects); err != nil {
+			if err := quarantine(basePath, key); err != nil {
+				return v, err
+			}
+			v.Corrupt = append(v.Corrupt, errors.Cause(err).(ErrCorruptEntry))
+		}
+	}
+
+	for path, objErr := range objects {
+		if objErr == nil || DoesNotExist(path) {
+			continue
+		}
+		rel, err := filepath.Rel(basePath, path)
+		if err != nil {
+			return v, errors.WithStack(err)
+		}
+		if err = quarantine(basePath, rel); err != nil {
+			return v, err
+		}
+		v.CorruptObjects++
+	}
+	return v, nil
+}